@@ -0,0 +1,263 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/parser"
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// ErrorConvention turns functions returning a status into wrappers that
+// return an error instead: nil for the Success values, and otherwise an
+// *Error that unwraps to the status. Statuses implement error themselves, so
+// the values of a status enum are sentinels for errors.Is.
+type ErrorConvention struct {
+	// Status is the C type of statuses, an enum or an integer typedef;
+	// every function returning it is wrapped. Functions also wraps, by
+	// path.Match pattern, functions returning other integers or enums.
+	Status    string
+	Functions []string
+
+	// Success lists the statuses meaning success, as enum constants or
+	// integers; defaults to 0. With NonNegative, every result of at least
+	// 0 is a success and returned next to the error instead, as POSIX
+	// functions returning a count or a file descriptor do.
+	Success     []string
+	NonNegative bool
+
+	// Message names a C function returning the message of a failure, such
+	// as calc_strerror(CalcStatus) or calc_last_error(void). It takes the
+	// status, nothing, or the opaque handle passed to the failed call.
+	Message string
+}
+
+// errorConvention is an ErrorConvention resolved against the module.
+type errorConvention struct {
+	status  string     // C name of the status type; empty for plain integers
+	enum    *sema.Enum // the status enum, if any
+	funcs   map[*sema.Function]bool
+	success []string // C names or integers
+	nonNeg  bool
+	message *sema.Function
+}
+
+// Forms of the message function.
+const (
+	messageOfStatus = iota
+	messageOfLastError
+	messageOfHandle
+)
+
+func findErrorConvention(module *sema.Module, ec *ErrorConvention) (*errorConvention, error) {
+	if ec == nil {
+		return nil, nil
+	}
+	if ec.Status == "" && len(ec.Functions) == 0 {
+		return nil, fmt.Errorf("error convention: a status type or functions are required")
+	}
+	for _, pattern := range ec.Functions {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("error convention: invalid function pattern %q: %w", pattern, err)
+		}
+	}
+
+	conv := &errorConvention{
+		status:  ec.Status,
+		funcs:   make(map[*sema.Function]bool),
+		success: ec.Success,
+		nonNeg:  ec.NonNegative,
+	}
+	if len(conv.success) == 0 {
+		conv.success = []string{"0"}
+	}
+
+	if ec.Status != "" {
+		i := slices.IndexFunc(module.Enums, func(e *sema.Enum) bool { return e.Name == ec.Status })
+		j := slices.IndexFunc(module.Typedefs, func(t *sema.Type) bool { return t.Name == ec.Status })
+		switch {
+		case i >= 0:
+			conv.enum = module.Enums[i]
+		case j >= 0 && module.Typedefs[j].Underlying().Kind == sema.KindInt:
+		default:
+			return nil, fmt.Errorf("error convention: status type %s is not an enum or integer typedef", ec.Status)
+		}
+	}
+
+	var errs []error
+	for _, s := range conv.success {
+		if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+			continue
+		}
+		if conv.enum == nil || !slices.ContainsFunc(conv.enum.Values, func(v parser.EnumValue) bool { return v.Name == s }) {
+			errs = append(errs, fmt.Errorf("error convention: success value %s is not an integer or a value of %s", s, ec.Status))
+		}
+	}
+
+	for _, fn := range module.Functions {
+		if fn.Name == ec.Message {
+			conv.message = fn
+		}
+		if conv.returnsStatus(fn) {
+			conv.funcs[fn] = true
+			continue
+		}
+		switch fn.Result.Underlying().Kind {
+		case sema.KindInt, sema.KindEnum:
+			if slices.ContainsFunc(ec.Functions, func(p string) bool { ok, _ := path.Match(p, fn.Name); return ok }) {
+				conv.funcs[fn] = true
+			}
+		}
+	}
+
+	if ec.Message != "" {
+		switch {
+		case conv.message == nil:
+			errs = append(errs, fmt.Errorf("error convention: message function %s not found", ec.Message))
+		case !conv.message.Result.IsString() || len(conv.message.Params) > 1 || conv.message.Variadic:
+			errs = append(errs, fmt.Errorf("error convention: message function %s must return a string and take at most one parameter", ec.Message))
+		case conv.funcs[conv.message]:
+			errs = append(errs, fmt.Errorf("error convention: message function %s returns a status", ec.Message))
+		}
+	}
+
+	return conv, errors.Join(errs...)
+}
+
+// returnsStatus reports whether fn returns the status type.
+func (c *errorConvention) returnsStatus(fn *sema.Function) bool {
+	if c.status == "" {
+		return false
+	}
+	for t := fn.Result; t != nil; t = t.Elem {
+		if t.Name == c.status && (t.Kind == sema.KindTypedef || t.Kind == sema.KindEnum) {
+			return true
+		}
+		if t.Kind != sema.KindTypedef {
+			break
+		}
+	}
+	return false
+}
+
+// messageForm returns how the message function is called.
+func (c *errorConvention) messageForm() int {
+	switch {
+	case len(c.message.Params) == 0:
+		return messageOfLastError
+	case c.message.Params[0].Type.Underlying().Kind == sema.KindHandle:
+		return messageOfHandle
+	default:
+		return messageOfStatus
+	}
+}
+
+// codeType returns the Go type of statuses.
+func (g *Generator) codeType() string {
+	if g.errors.enum != nil {
+		return g.names.typeName(g.errors.enum.Name)
+	}
+	return g.names.statusType()
+}
+
+func (g *Generator) errorData() ErrorData {
+	c := g.errors
+	data := ErrorData{
+		GoName:      g.names.errorType(),
+		CodeType:    g.codeType(),
+		DeclareCode: c.enum == nil,
+		Errno:       len(g.errno) > 0,
+		Status:      c.status,
+	}
+	if data.Status == "" {
+		data.Status = "status"
+	}
+
+	if c.message != nil && c.messageForm() == messageOfStatus {
+		arg := "c"
+		if c.enum == nil {
+			arg = fmt.Sprintf("%s(c)", g.goType(c.message.Params[0].Type))
+		}
+		data.Describe = fmt.Sprintf("%s(%s)", g.names.funcName(c.message.Name), arg)
+	}
+
+	return data
+}
+
+// statusCheck returns the statements returning an *Error for a failure
+// status, given the Go expression of the status and the zero values of the
+// other results.
+func (g *Generator) statusCheck(fn *sema.Function, status string, params []ParamData, zeros []string) string {
+	c := g.errors
+	code := g.codeType()
+	if c.enum == nil || !c.returnsStatus(fn) {
+		status = fmt.Sprintf("%s(%s)", code, status)
+	}
+
+	var conds []string
+	for _, s := range c.success {
+		if name := g.names.valueName(s); c.enum != nil && name != "" {
+			s = name
+		}
+		conds = append(conds, "status != "+s)
+	}
+	if c.nonNeg {
+		conds = []string{"status < 0"}
+	}
+
+	fields := fmt.Sprintf("Op: %q, Code: status", fn.Name)
+	if g.errno[fn] {
+		fields += ", Errno: syscall.Errno(errno)"
+	}
+	if c.message != nil {
+		var msg string
+		switch c.messageForm() {
+		case messageOfLastError:
+			msg = g.names.funcName(c.message.Name) + "()"
+		case messageOfHandle:
+			handle := c.message.Params[0].Type.Underlying().Name
+			for i, p := range fn.Params {
+				if u := p.Type.Underlying(); u.Kind == sema.KindHandle && u.Name == handle {
+					msg = fmt.Sprintf("%s(%s)", g.names.funcName(c.message.Name), params[i].GoName)
+					if method, ok := g.names.methodOf(c.message.Name); ok {
+						msg = fmt.Sprintf("%s.%s()", params[i].GoName, method)
+					}
+					break
+				}
+			}
+		}
+		if msg != "" {
+			fields += ", Message: " + msg
+		}
+	}
+
+	ret := strings.Join(append(zeros, fmt.Sprintf("&%s{%s}", g.names.errorType(), fields)), ", ")
+	return fmt.Sprintf("if status := %s; %s {\n\treturn %s\n}", status, strings.Join(conds, " && "), ret)
+}
+
+// zeroValue returns the zero value of the Go type m maps t to.
+func zeroValue(t *sema.Type, m Mapping) string {
+	if m.converts() {
+		if strings.HasPrefix(m.GoType, "*") {
+			return "nil"
+		}
+		return fmt.Sprintf("*new(%s)", m.GoType)
+	}
+
+	switch u := t.Underlying(); {
+	case t.IsString():
+		return `""`
+	case u.Kind == sema.KindBool:
+		return "false"
+	case u.Kind == sema.KindStruct || u.Kind == sema.KindArray:
+		return m.GoType + "{}"
+	case strings.HasPrefix(m.GoType, "*"):
+		return "nil"
+	default:
+		return "0"
+	}
+}
@@ -1,540 +1,807 @@
 package generator
 
 import (
-	"bytes"
 	"fmt"
+	"maps"
+	"path"
+	"slices"
 	"strings"
 	"text/template"
-	"unicode"
 
-	"github.com/ardanlabs/ffi-converter/parser"
+	"github.com/ardanlabs/ffi-converter/sema"
 )
 
 type Generator struct {
-	packageName string
-	libName     string
-	header      *parser.Header
+	opts      Options
+	module    *sema.Module
+	templates *template.Template
+
+	names         *namer
+	managed       map[string]*managedHandle
+	outs          map[*sema.Function][]bool
+	slices        map[*sema.Function]map[int]int
+	buffered      map[*sema.Function]int
+	owned         map[*sema.Function]string
+	lists         *stringLists
+	cstrings      bool // the C string helpers are generated
+	wide          *wideStrings
+	mirrors       map[*sema.Struct]*mirror
+	mirrorPtrs    map[*sema.Struct]bool // mirrors passed or returned by pointer
+	errors        *errorConvention
+	errno         map[*sema.Function]bool
+	mappers       []TypeMapper
+	defaultMapper defaultMapper
+	imports       map[string]string
 }
 
-func New(packageName, libName string, header *parser.Header) *Generator {
-	return &Generator{
-		packageName: packageName,
-		libName:     libName,
-		header:      header,
+// New returns a generator for module. It validates opts, fills in defaults
+// and applies the declaration filters.
+func New(module *sema.Module, opts Options) (*Generator, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
 	}
-}
-
-func (g *Generator) Generate() (map[string]string, error) {
-	files := make(map[string]string)
 
-	loaderCode, err := g.generateLoader()
+	filtered, err := opts.filter(module)
 	if err != nil {
-		return nil, fmt.Errorf("generating loader: %w", err)
+		return nil, err
 	}
-	files["loader.go"] = loaderCode
 
-	typesCode, err := g.generateTypes()
+	templates, err := loadTemplates(opts.Templates)
 	if err != nil {
-		return nil, fmt.Errorf("generating types: %w", err)
+		return nil, fmt.Errorf("loading templates: %w", err)
 	}
-	files["types.go"] = typesCode
 
-	funcsCode, err := g.generateFunctions()
+	sliceParams, err := findSliceParams(filtered, opts)
 	if err != nil {
-		return nil, fmt.Errorf("generating functions: %w", err)
+		return nil, err
 	}
-	files["functions.go"] = funcsCode
 
-	return files, nil
-}
+	outs, err := findOutParams(filtered, opts, sliceParams)
+	if err != nil {
+		return nil, err
+	}
 
-func (g *Generator) generateLoader() (string, error) {
-	tmpl := `package {{.Package}}
+	managed, err := findHandlePairs(filtered, opts.HandlePairs, opts.DetectHandlePairs, outs)
+	if err != nil {
+		return nil, err
+	}
 
-import (
-	"fmt"
-	"path/filepath"
-	"runtime"
+	mirrors, err := findMirrors(filtered, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	"github.com/jupiterrider/ffi"
-)
+	owned, err := findOwnedResults(filtered, opts.OwnedResults, opts.StringLists)
+	if err != nil {
+		return nil, err
+	}
 
-var lib ffi.Lib
+	lists, err := findStringLists(filtered, opts, sliceParams, owned)
+	if err != nil {
+		return nil, err
+	}
 
-func Load(path string) error {
-	var err error
-	lib, err = ffi.Load(getLibraryPath(path))
+	wide, err := findWideStrings(filtered, opts, sliceParams, outs, lists)
 	if err != nil {
-		return fmt.Errorf("failed to load library: %w", err)
+		return nil, err
 	}
 
-	if err := loadFuncs(); err != nil {
-		return err
+	conv, err := findErrorConvention(filtered, opts.Errors)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffered map[*sema.Function]int
+	if opts.StringBuffers {
+		buffered = findStringBuffers(filtered, opts, sliceParams, outs, conv)
+	}
+
+	names := newNamer(opts)
+	cstrings := usesCStrings(filtered, lists)
+	names.useCStrings = cstrings
+	names.useStringArrays = lists.used
+	names.useWideStrings = len(wide.used) > 0
+	if err := names.assign(filtered, managed, buffered, conv, mirrors); err != nil {
+		return nil, err
+	}
+
+	g := &Generator{
+		opts:          opts,
+		module:        filtered,
+		templates:     templates,
+		names:         names,
+		managed:       managed,
+		outs:          outs,
+		slices:        sliceParams,
+		buffered:      buffered,
+		owned:         owned,
+		lists:         lists,
+		cstrings:      cstrings,
+		wide:          wide,
+		mirrors:       mirrors,
+		mirrorPtrs:    make(map[*sema.Struct]bool),
+		errors:        conv,
+		errno:         make(map[*sema.Function]bool),
+		mappers:       slices.Clone(opts.TypeMappers),
+		defaultMapper: defaultMapper{names: names},
+		imports:       maps.Clone(knownImports),
+	}
+	for _, fn := range filtered.Functions {
+		if slices.ContainsFunc(opts.Errno, func(p string) bool { ok, _ := path.Match(p, fn.Name); return ok }) {
+			g.errno[fn] = true
+		}
+	}
+	if len(opts.Types) > 0 {
+		g.mappers = append(g.mappers, typeTable(opts.Types))
+	}
+	if len(managed) > 0 {
+		g.mappers = append(g.mappers, handleMapper{managed: managed, names: names})
+	}
+	if len(mirrors) > 0 {
+		g.mappers = append(g.mappers, mirrorMapper{g: g})
+		g.findMirrorPtrs()
 	}
 
-	return nil
+	return g, nil
 }
 
-func getLibraryPath(basePath string) string {
-	var filename string
-	switch runtime.GOOS {
-	case "linux", "freebsd":
-		filename = "lib{{.LibName}}.so"
-	case "darwin":
-		filename = "lib{{.LibName}}.dylib"
-	case "windows":
-		filename = "{{.LibName}}.dll"
-	default:
-		filename = "lib{{.LibName}}.so"
-	}
-	return filepath.Join(basePath, filename)
-}
-`
+// Generate returns the generated files sorted by name. The output depends
+// only on the module and the options.
+func (g *Generator) Generate() ([]File, error) {
+	if err := g.checkTargets(); err != nil {
+		return nil, err
+	}
 
-	t, err := template.New("loader").Parse(tmpl)
-	if err != nil {
-		return "", err
+	var names []string
+	goFiles := make(map[string]*goFile)
+	file := func(name string) *goFile {
+		if g.opts.Layout == LayoutSingle {
+			name = g.opts.Package + ".go"
+		}
+		if _, ok := goFiles[name]; !ok {
+			goFiles[name] = newGoFile(g.opts.Package, g.imports)
+			names = append(names, name)
+		}
+		return goFiles[name]
 	}
 
-	var buf bytes.Buffer
-	err = t.Execute(&buf, map[string]string{
-		"Package": g.packageName,
-		"LibName": g.libName,
-	})
-	if err != nil {
-		return "", err
+	if err := g.generateLoader(file("loader.go")); err != nil {
+		return nil, fmt.Errorf("generating loader: %w", err)
 	}
 
-	return buf.String(), nil
-}
+	if err := g.generateTypes(file("types.go")); err != nil {
+		return nil, fmt.Errorf("generating types: %w", err)
+	}
 
-func (g *Generator) generateTypes() (string, error) {
-	var buf bytes.Buffer
+	if err := g.generateFunctions(file("functions.go")); err != nil {
+		return nil, fmt.Errorf("generating functions: %w", err)
+	}
 
-	fmt.Fprintf(&buf, "package %s\n\n", g.packageName)
-	fmt.Fprintf(&buf, "import \"github.com/jupiterrider/ffi\"\n\n")
+	if len(g.errno) > 0 {
+		if err := g.addTemplate(file("errno.go"), "errno support", "errno.tmpl", nil); err != nil {
+			return nil, fmt.Errorf("generating errno support: %w", err)
+		}
+	}
 
-	for _, s := range g.header.Structs {
-		if s.IsOpaque {
-			fmt.Fprintf(&buf, "type %s uintptr\n\n", toGoName(s.Name))
-			continue
+	if g.cstrings {
+		if err := g.addTemplate(file("cstring.go"), "C string support", "cstring.tmpl", nil); err != nil {
+			return nil, fmt.Errorf("generating C string support: %w", err)
 		}
+	}
 
-		fmt.Fprintf(&buf, "type %s struct {\n", toGoName(s.Name))
-		for _, f := range s.Fields {
-			goType := cTypeToGoType(f.Type, g.header)
-			fmt.Fprintf(&buf, "\t%s %s\n", toGoName(f.Name), goType)
+	if g.lists.used {
+		if err := g.addTemplate(file("stringlist.go"), "string list support", "string_array.tmpl", nil); err != nil {
+			return nil, fmt.Errorf("generating string list support: %w", err)
 		}
-		fmt.Fprintf(&buf, "}\n\n")
+	}
 
-		fmt.Fprintf(&buf, "var FFIType%s = ffi.NewType(\n", toGoName(s.Name))
-		for _, f := range s.Fields {
-			ffiType := cTypeToFFIType(f.Type, g.header)
-			fmt.Fprintf(&buf, "\t%s,\n", ffiType)
+	if len(g.wide.used) > 0 {
+		if err := g.addTemplate(file("widestring.go"), "wide string support", "wide_string.tmpl", g.wide.wideStringData()); err != nil {
+			return nil, fmt.Errorf("generating wide string support: %w", err)
 		}
-		fmt.Fprintf(&buf, ")\n\n")
 	}
 
-	for _, e := range g.header.Enums {
-		fmt.Fprintf(&buf, "type %s int32\n\n", toGoName(e.Name))
-		fmt.Fprintf(&buf, "const (\n")
-		for i, v := range e.Values {
-			if v.Value != "" {
-				fmt.Fprintf(&buf, "\t%s %s = %s\n", toGoEnumName(e.Name, v.Name), toGoName(e.Name), v.Value)
-			} else if i == 0 {
-				fmt.Fprintf(&buf, "\t%s %s = iota\n", toGoEnumName(e.Name, v.Name), toGoName(e.Name))
-			} else {
-				fmt.Fprintf(&buf, "\t%s\n", toGoEnumName(e.Name, v.Name))
-			}
+	if hasVariadic(g.module.Functions) {
+		if err := g.generateVariadic(file("variadic.go")); err != nil {
+			return nil, fmt.Errorf("generating variadic support: %w", err)
 		}
-		fmt.Fprintf(&buf, ")\n\n")
 	}
 
-	return buf.String(), nil
+	slices.Sort(names)
+
+	files := make([]File, 0, len(names))
+	for _, name := range names {
+		f := goFiles[name]
+
+		header, err := g.execute("header.tmpl", FileData{Package: g.opts.Package, Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("generating %s: %w", name, err)
+		}
+		f.header = header
+
+		src, err := f.render()
+		if err != nil {
+			return nil, fmt.Errorf("generating %s: %w", name, err)
+		}
+		files = append(files, File{Name: name, Content: src})
+	}
+
+	return files, nil
 }
 
-func (g *Generator) generateFunctions() (string, error) {
-	var buf bytes.Buffer
+// GenerateTo generates the files and writes them to w in name order.
+func (g *Generator) GenerateTo(w FileWriter) error {
+	files, err := g.Generate()
+	if err != nil {
+		return err
+	}
 
-	fmt.Fprintf(&buf, "package %s\n\n", g.packageName)
-	fmt.Fprintf(&buf, "import (\n")
-	fmt.Fprintf(&buf, "\t\"fmt\"\n")
-	fmt.Fprintf(&buf, "\t\"unsafe\"\n\n")
-	fmt.Fprintf(&buf, "\t\"github.com/jupiterrider/ffi\"\n")
-	fmt.Fprintf(&buf, "\t\"golang.org/x/sys/unix\"\n")
-	fmt.Fprintf(&buf, ")\n\n")
+	for _, f := range files {
+		if err := w.WriteFile(f.Name, f.Content); err != nil {
+			return fmt.Errorf("writing %s: %w", f.Name, err)
+		}
+	}
 
-	fmt.Fprintf(&buf, "var _ = unix.BytePtrFromString\n\n")
+	return nil
+}
 
-	fmt.Fprintf(&buf, "var (\n")
-	for _, fn := range g.header.Functions {
-		funcVarName := toLowerCamel(fn.Name) + "Func"
-		fmt.Fprintf(&buf, "\t%s ffi.Fun\n", funcVarName)
+// addTemplate executes the template name and adds the result to f as the
+// declaration decl.
+func (g *Generator) addTemplate(f *goFile, decl, name string, data any) error {
+	src, err := g.execute(name, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", decl, err)
 	}
-	fmt.Fprintf(&buf, ")\n\n")
+	f.add(decl, src)
+	return nil
+}
 
-	fmt.Fprintf(&buf, "func loadFuncs() error {\n")
-	fmt.Fprintf(&buf, "\tvar err error\n\n")
+func (g *Generator) generateLoader(f *goFile) error {
+	// verifyLayouts checks the structs declared with a libffi type, through
+	// their mirror if they have one.
+	var layout LayoutData
+	for _, s := range g.module.Structs {
+		if s.Opaque || !s.Natural || g.managed[s.Name] != nil {
+			continue
+		}
+		data := g.structData(s)
+		if m := data.Mirror; m != nil {
+			data.GoName, data.Fields = m.GoName, m.Fields
+		}
+		if data.Elements > 0 {
+			layout.Structs = append(layout.Structs, data)
+		}
+	}
 
-	for _, fn := range g.header.Functions {
-		funcVarName := toLowerCamel(fn.Name) + "Func"
-		retFFI := cTypeToFFIType(fn.ReturnType, g.header)
+	if err := g.addTemplate(f, "loader", "loader.tmpl", LoaderData{
+		Package:       g.opts.Package,
+		LibName:       g.opts.LibName,
+		VerifyLayouts: len(layout.Structs) > 0,
+	}); err != nil {
+		return err
+	}
 
-		var argFFIs []string
-		for _, p := range fn.Params {
-			argFFIs = append(argFFIs, cTypeToFFIType(p.Type, g.header))
+	if len(layout.Structs) == 0 {
+		return nil
+	}
+	return g.addTemplate(f, "layout check", "layout.tmpl", layout)
+}
+
+func (g *Generator) generateTypes(f *goFile) error {
+	for _, s := range g.module.Structs {
+		if g.managed[s.Name] != nil {
+			if err := g.addTemplate(f, "struct "+s.Name, "managed_handle.tmpl", g.managedHandleData(s)); err != nil {
+				return err
+			}
+			continue
 		}
 
-		if len(argFFIs) == 0 {
-			fmt.Fprintf(&buf, "\tif %s, err = lib.Prep(\"%s\", %s); err != nil {\n",
-				funcVarName, fn.Name, retFFI)
-		} else {
-			fmt.Fprintf(&buf, "\tif %s, err = lib.Prep(\"%s\", %s, %s); err != nil {\n",
-				funcVarName, fn.Name, retFFI, strings.Join(argFFIs, ", "))
+		name := "struct.tmpl"
+		switch {
+		case s.Opaque:
+			name = "handle.tmpl"
+		case !s.Natural:
+			// The zero-length field aligning packed_struct.tmpl is at most a
+			// uint64.
+			if s.Align > 8 {
+				return fmt.Errorf("struct %s is aligned to %d bytes, but Go cannot align types to more than 8", s.Name, s.Align)
+			}
+			name = "packed_struct.tmpl"
+		}
+
+		if err := g.addTemplate(f, "struct "+s.Name, name, g.structData(s)); err != nil {
+			return err
 		}
-		fmt.Fprintf(&buf, "\t\treturn fmt.Errorf(\"%s: %%w\", err)\n", fn.Name)
-		fmt.Fprintf(&buf, "\t}\n\n")
 	}
 
-	fmt.Fprintf(&buf, "\treturn nil\n")
-	fmt.Fprintf(&buf, "}\n\n")
+	for _, e := range g.module.Enums {
+		data := EnumData{Name: e.Name, GoName: g.names.typeName(e.Name)}
+		for _, v := range e.Values {
+			data.Values = append(data.Values, EnumValueData{Name: v.Name, GoName: g.names.valueName(v.Name), Value: v.Value})
+		}
+
+		if err := g.addTemplate(f, "enum "+e.Name, "enum.tmpl", data); err != nil {
+			return err
+		}
+	}
 
-	for _, fn := range g.header.Functions {
-		code := g.generateFunctionWrapper(fn)
-		fmt.Fprintf(&buf, "%s\n", code)
+	if g.errors != nil {
+		if err := g.addTemplate(f, "error type", "error.tmpl", g.errorData()); err != nil {
+			return err
+		}
 	}
 
-	return buf.String(), nil
+	return nil
 }
 
-func (g *Generator) generateFunctionWrapper(fn parser.Function) string {
-	var buf bytes.Buffer
+func (g *Generator) structData(s *sema.Struct) StructData {
+	data := StructData{
+		Name:   s.Name,
+		GoName: g.names.typeName(s.Name),
+		FFIVar: g.names.ffiTypeVar(s.Name),
+		Size:   s.Size,
+		Align:  s.Align,
+	}
+	if s.Opaque {
+		return data
+	}
 
-	goFuncName := toGoName(fn.Name)
-	funcVarName := toLowerCamel(fn.Name) + "Func"
+	switch {
+	case s.Natural:
+	case s.Align >= 8:
+		data.AlignType = "uint64"
+	case s.Align >= 4:
+		data.AlignType = "uint32"
+	case s.Align >= 2:
+		data.AlignType = "uint16"
+	}
 
-	var params []string
-	for _, p := range fn.Params {
-		goType := cTypeToGoType(p.Type, g.header)
-		paramName := toLowerCamel(p.Name)
-		if paramName == "" {
-			paramName = "arg"
+	for _, f := range s.Fields {
+		if f.Type.Flexible {
+			continue
+		}
+
+		// Packed structs are read through accessors that copy raw memory, so
+		// C strings stay plain pointers there.
+		goType := g.fieldType(f.Type)
+		if !s.Natural {
+			goType = g.rawGoType(f.Type)
 		}
-		params = append(params, fmt.Sprintf("%s %s", paramName, goType))
-	}
-	paramsStr := strings.Join(params, ", ")
 
-	retGoType := cTypeToGoType(fn.ReturnType, g.header)
-	hasReturn := fn.ReturnType.Name != "void"
+		ffiTypes := []string{g.ffiType(f.Type)}
+		if u := f.Type.Underlying(); u.Kind == sema.KindArray {
+			ffiTypes = make([]string, u.Len)
+			for i := range ffiTypes {
+				ffiTypes[i] = g.ffiType(u.Elem)
+			}
+		}
 
-	if hasReturn {
-		fmt.Fprintf(&buf, "func %s(%s) %s {\n", goFuncName, paramsStr, retGoType)
-	} else {
-		fmt.Fprintf(&buf, "func %s(%s) {\n", goFuncName, paramsStr)
+		data.Fields = append(data.Fields, FieldData{
+			Name:     f.Name,
+			GoName:   g.names.fieldName(s.Name, f.Name),
+			Setter:   g.names.setterName(s.Name, f.Name),
+			GoType:   goType,
+			FFITypes: ffiTypes,
+			Index:    data.Elements,
+			Offset:   f.Offset,
+			Size:     f.Type.Size,
+			End:      f.Offset + f.Type.Size,
+		})
+		data.Elements += len(ffiTypes)
+	}
+	if m := g.mirrors[s]; m != nil {
+		data.Mirror, data.Fields = g.mirrorData(s, m, data.Fields)
+	}
+
+	if fm := s.FlexibleMember(); fm != nil {
+		flex := &FlexibleData{
+			GoName:   g.names.fieldName(s.Name, fm.Name),
+			ElemType: g.rawGoType(fm.Type.Elem),
+			Offset:   fm.Offset,
+		}
+		if fm.CountField != nil {
+			countExpr := "s.%s"
+			if !s.Natural {
+				countExpr = "s.%s()"
+			}
+			flex.Count = fmt.Sprintf(countExpr, g.names.fieldName(s.Name, fm.CountField.Name))
+		}
+		data.Flexible = flex
 	}
 
-	for _, p := range fn.Params {
-		if isStringType(p.Type) {
-			paramName := toLowerCamel(p.Name)
-			if paramName == "" {
-				paramName = "arg"
+	return data
+}
+
+func (g *Generator) generateFunctions(f *goFile) error {
+	var data FunctionsData
+	for _, fn := range g.module.Functions {
+		if fn.Result.IsPacked() {
+			return fmt.Errorf("%s: returns packed or over-aligned struct %s by value, which libffi cannot describe", fn.Name, fn.Result.Name)
+		}
+		for _, p := range fn.Params {
+			if p.Type.IsPacked() {
+				return fmt.Errorf("%s: takes packed or over-aligned struct %s by value, which libffi cannot describe; pass a pointer instead", fn.Name, p.Type.Name)
 			}
-			fmt.Fprintf(&buf, "\t%sPtr, _ := unix.BytePtrFromString(%s)\n", paramName, paramName)
 		}
+		fd, err := g.functionData(fn)
+		if err != nil {
+			return err
+		}
+		data.Functions = append(data.Functions, fd)
 	}
 
-	if hasReturn {
-		if needsFFIArg(fn.ReturnType) {
-			fmt.Fprintf(&buf, "\tvar result ffi.Arg\n")
-		} else if isStringReturnType(fn.ReturnType) {
-			fmt.Fprintf(&buf, "\tvar resultPtr *byte\n")
-		} else if isOpaqueHandle(fn.ReturnType, g.header) {
-			fmt.Fprintf(&buf, "\tvar result %s\n", retGoType)
-		} else {
-			fmt.Fprintf(&buf, "\tvar result %s\n", retGoType)
+	if slices.Contains(slices.Collect(maps.Values(g.owned)), libcFree) {
+		data.LibcFree = g.names.libcFreeVar()
+	}
+	data.Errno = len(g.errno) > 0
+
+	if len(data.Functions) > 0 {
+		if err := g.addTemplate(f, "function variables", "function_vars.tmpl", data); err != nil {
+			return err
 		}
 	}
 
-	var callArgs []string
-	if hasReturn {
-		if isStringReturnType(fn.ReturnType) {
-			callArgs = append(callArgs, "unsafe.Pointer(&resultPtr)")
-		} else {
-			callArgs = append(callArgs, "unsafe.Pointer(&result)")
+	if err := g.addTemplate(f, "loadFuncs", "load_funcs.tmpl", data); err != nil {
+		return err
+	}
+	if data.Errno || data.LibcFree != "" {
+		if err := g.addTemplate(f, "loadLibc", "libc.tmpl", nil); err != nil {
+			return err
 		}
-	} else {
-		callArgs = append(callArgs, "nil")
 	}
 
-	for _, p := range fn.Params {
-		paramName := toLowerCamel(p.Name)
-		if paramName == "" {
-			paramName = "arg"
+	for i, fd := range data.Functions {
+		if g.isDestructor(g.module.Functions[i]) || g.isFree(g.module.Functions[i]) {
+			continue
+		}
+		if err := g.addTemplate(f, "function "+fd.Name, "function.tmpl", fd); err != nil {
+			return err
 		}
-		if isStringType(p.Type) {
-			callArgs = append(callArgs, fmt.Sprintf("unsafe.Pointer(&%sPtr)", paramName))
-		} else if isStructByValue(p.Type, g.header) {
-			callArgs = append(callArgs, fmt.Sprintf("&%s", paramName))
-		} else {
-			callArgs = append(callArgs, fmt.Sprintf("unsafe.Pointer(&%s)", paramName))
+		fn := g.module.Functions[i]
+		if buf, ok := g.buffered[fn]; ok {
+			if err := g.addTemplate(f, "function "+fd.Name+" string", "string_buffer.tmpl", g.stringBufferData(fn, fd, buf)); err != nil {
+				return err
+			}
 		}
 	}
 
-	fmt.Fprintf(&buf, "\t%s.Call(%s)\n", funcVarName, strings.Join(callArgs, ", "))
+	return nil
+}
 
-	if hasReturn {
-		if needsFFIArg(fn.ReturnType) {
-			if fn.ReturnType.Name == "bool" || (fn.ReturnType.Name == "uint8" && !fn.ReturnType.IsPointer) {
-				fmt.Fprintf(&buf, "\treturn result.Bool()\n")
-			} else {
-				fmt.Fprintf(&buf, "\treturn %s(result)\n", retGoType)
-			}
-		} else if isStringReturnType(fn.ReturnType) {
-			fmt.Fprintf(&buf, "\tif resultPtr == nil {\n")
-			fmt.Fprintf(&buf, "\t\treturn \"\"\n")
-			fmt.Fprintf(&buf, "\t}\n")
-			fmt.Fprintf(&buf, "\treturn unix.BytePtrToString(resultPtr)\n")
-		} else {
-			fmt.Fprintf(&buf, "\treturn result\n")
+func (g *Generator) functionData(fn *sema.Function) (FunctionData, error) {
+	data := FunctionData{
+		Name:      fn.Name,
+		GoName:    g.names.funcName(fn.Name),
+		VarName:   g.names.funcVar(fn.Name),
+		Variadic:  fn.Variadic,
+		Errno:     g.errno[fn],
+		FFIResult: g.ffiType(fn.Result),
+	}
+
+	mappings := make([]Mapping, len(fn.Params))
+	for i, p := range fn.Params {
+		mappings[i] = g.mapType(p.Type)
+	}
+	paramNames := g.names.paramNames(fn, g.imports)
+	outs := g.outs[fn]
+	sliceParams := g.slices[fn]
+	lengths := make(map[int][]string)
+	for _, ptr := range slices.Sorted(maps.Keys(sliceParams)) {
+		lengths[sliceParams[ptr]] = append(lengths[sliceParams[ptr]], fmt.Sprintf("len(%s)", paramNames[ptr]))
+	}
+
+	var outReturns []ReturnData
+	var stringParams []int
+	listLength := "-1"
+	for i, p := range fn.Params {
+		paramName := paramNames[i]
+		m := mappings[i]
+		pd := ParamData{
+			Name:   p.Name,
+			GoName: paramName,
+			GoType: m.GoType,
 		}
-	}
 
-	fmt.Fprintf(&buf, "}\n")
+		// The length of a string list result is returned as the length of
+		// the slice.
+		if g.lists.isListLength(fn, i) {
+			listLength = fmt.Sprintf("int(%s)", g.outParamData(fn, p, &pd).Value)
+			data.Params = append(data.Params, pd)
+			data.FFIParams = append(data.FFIParams, m.FFIType)
+			continue
+		}
 
-	return buf.String()
-}
+		_, isSlice := sliceParams[i]
+		if isSlice && isStringArray(p.Type) || g.lists.params[fn][i] {
+			stringParams = append(stringParams, len(data.Params))
+			pd.GoType = "[]string"
+			pd.Setup = fmt.Sprintf("%sPtr, _ := stringArrayToC(%s, %t, pinner)", paramName, paramName, !isSlice)
+			pd.Arg = fmt.Sprintf("unsafe.Pointer(&%sPtr)", paramName)
+			data.Pinner = true
+			data.Params = append(data.Params, pd)
+			data.FFIParams = append(data.FFIParams, m.FFIType)
+			continue
+		}
 
-func cTypeToGoType(ct parser.CType, header *parser.Header) string {
-	if ct.IsPointer && (ct.Name == "char" || ct.Name == "char *") {
-		return "string"
-	}
+		if outs != nil && outs[i] {
+			ret := g.outParamData(fn, p, &pd)
+			outReturns = append(outReturns, ret)
+			data.Params = append(data.Params, pd)
+			data.FFIParams = append(data.FFIParams, m.FFIType)
+			continue
+		}
 
-	if ct.IsPointer {
-		for _, s := range header.Structs {
-			if s.Name == ct.Name && !s.IsOpaque {
-				return "*" + toGoName(ct.Name)
+		if isSlice || g.opts.isBuffer(fn, p) {
+			if err := g.sliceParamData(p, &pd); err != nil {
+				return data, fmt.Errorf("%s: slice %s: %w", fn.Name, p.Name, err)
 			}
+			data.Params = append(data.Params, pd)
+			data.FFIParams = append(data.FFIParams, m.FFIType)
+			continue
 		}
-		return "uintptr"
-	}
-
-	switch ct.Name {
-	case "void":
-		return ""
-	case "bool":
-		return "bool"
-	case "char":
-		if ct.IsUnsigned {
-			return "uint8"
-		}
-		return "int8"
-	case "short":
-		if ct.IsUnsigned {
-			return "uint16"
-		}
-		return "int16"
-	case "int":
-		if ct.IsUnsigned {
-			return "uint32"
-		}
-		return "int32"
-	case "long":
-		if ct.IsUnsigned {
-			return "uint64"
-		}
-		return "int64"
-	case "int8_t":
-		return "int8"
-	case "uint8_t":
-		return "uint8"
-	case "int16_t":
-		return "int16"
-	case "uint16_t":
-		return "uint16"
-	case "int32_t":
-		return "int32"
-	case "uint32_t":
-		return "uint32"
-	case "int64_t":
-		return "int64"
-	case "uint64_t":
-		return "uint64"
-	case "size_t":
-		return "uint64"
-	case "float":
-		return "float32"
-	case "double":
-		return "float64"
-	default:
-		for _, s := range header.Structs {
-			if s.Name == ct.Name {
-				return toGoName(ct.Name)
+		// Slices sharing a length pass the shortest one.
+		if lens, ok := lengths[i]; ok {
+			n := lens[0]
+			if len(lens) > 1 {
+				n = fmt.Sprintf("min(%s)", strings.Join(lens, ", "))
 			}
-		}
-		for _, e := range header.Enums {
-			if e.Name == ct.Name {
-				return toGoName(ct.Name)
+			cType := m.GoType
+			if m.converts() {
+				cType = m.CType
 			}
+			pd.Length = true
+			pd.Setup = fmt.Sprintf("%sC := %s(%s)", paramName, cType, n)
+			pd.Arg = fmt.Sprintf("unsafe.Pointer(&%sC)", paramName)
+			data.Params = append(data.Params, pd)
+			data.FFIParams = append(data.FFIParams, m.FFIType)
+			continue
+		}
+
+		value := paramName
+		if m.converts() {
+			value = paramName + "C"
+			pd.Setup = fmt.Sprintf("%s := %s", value, fmt.Sprintf(m.ToC, paramName))
 		}
-		return toGoName(ct.Name)
+		// Mirrors report the strings they cannot pass to C as string
+		// parameters do.
+		if g.convertsToMirror(p.Type, m) {
+			stringParams = append(stringParams, len(data.Params))
+			pd.Setup = fmt.Sprintf("%s, _ := %s", value, fmt.Sprintf(m.ToC, paramName))
+			data.Pinner = true
+		}
+		// What C writes through a non-const pointer to a mirror is copied
+		// back to the caller's struct.
+		if s := g.mirrorPtrOf(p.Type); s != nil && !p.Type.Underlying().Elem.Const && m.CType == "*"+g.names.mirrorType(s.Name) {
+			pd.After = fmt.Sprintf("if %s != nil {\n\t*%s = %s(*%s)\n}", paramName, paramName, g.names.fromCFunc(s.Name), value)
+		}
+		if h := p.Type.Underlying(); g.opts.CleanupHandles && h.Kind == sema.KindHandle && g.managed[h.Name] != nil {
+			data.KeepAlive = append(data.KeepAlive, paramName)
+		}
+
+		enc, isWide := g.wide.params[fn][i]
+		switch {
+		case p.Type.IsString():
+			stringParams = append(stringParams, len(data.Params))
+			pd.Setup = fmt.Sprintf("%sPtr, _ := bytePtrFromString(%s)", paramName, paramName)
+			pd.Arg = fmt.Sprintf("unsafe.Pointer(&%sPtr)", paramName)
+		case isWide:
+			stringParams = append(stringParams, len(data.Params))
+			pd.GoType = "string"
+			pd.Setup = fmt.Sprintf("%sPtr, _ := %s(%s)", paramName, wideHelpers[enc].fromString, paramName)
+			pd.Arg = fmt.Sprintf("unsafe.Pointer(&%sPtr)", paramName)
+		case p.Type.IsStructValue():
+			pd.Arg = "&" + value
+		default:
+			pd.Arg = fmt.Sprintf("unsafe.Pointer(&%s)", value)
+		}
+
+		data.Params = append(data.Params, pd)
+		data.FFIParams = append(data.FFIParams, m.FFIType)
 	}
-}
 
-func cTypeToFFIType(ct parser.CType, header *parser.Header) string {
-	if ct.IsPointer {
-		return "&ffi.TypePointer"
-	}
-
-	switch ct.Name {
-	case "void":
-		return "&ffi.TypeVoid"
-	case "bool":
-		return "&ffi.TypeUint8"
-	case "char":
-		if ct.IsUnsigned {
-			return "&ffi.TypeUint8"
-		}
-		return "&ffi.TypeSint8"
-	case "short":
-		if ct.IsUnsigned {
-			return "&ffi.TypeUint16"
-		}
-		return "&ffi.TypeSint16"
-	case "int":
-		if ct.IsUnsigned {
-			return "&ffi.TypeUint32"
-		}
-		return "&ffi.TypeSint32"
-	case "long":
-		if ct.IsUnsigned {
-			return "&ffi.TypeUint64"
-		}
-		return "&ffi.TypeSint64"
-	case "int8_t":
-		return "&ffi.TypeSint8"
-	case "uint8_t":
-		return "&ffi.TypeUint8"
-	case "int16_t":
-		return "&ffi.TypeSint16"
-	case "uint16_t":
-		return "&ffi.TypeUint16"
-	case "int32_t":
-		return "&ffi.TypeSint32"
-	case "uint32_t":
-		return "&ffi.TypeUint32"
-	case "int64_t":
-		return "&ffi.TypeSint64"
-	case "uint64_t":
-		return "&ffi.TypeUint64"
-	case "size_t":
-		return "&ffi.TypeUint64"
-	case "float":
-		return "&ffi.TypeFloat"
-	case "double":
-		return "&ffi.TypeDouble"
-	default:
-		for _, s := range header.Structs {
-			if s.Name == ct.Name && !s.IsOpaque {
-				return "&FFIType" + toGoName(ct.Name)
-			}
+	data.GoParams = data.Params
+	if method, ok := g.names.methodOf(fn.Name); ok {
+		data.Receiver = &data.Params[0]
+		data.GoParams = data.Params[1:]
+		data.FlatName = data.GoName
+		data.GoName = method
+	}
+	data.GoParams = slices.DeleteFunc(slices.Clone(data.GoParams), func(p ParamData) bool { return p.Out || p.Length })
+	data.Returns = outReturns
+
+	if fn.Result.Underlying().Kind == sema.KindVoid {
+		return g.errnoResult(data, stringParams), nil
+	}
+
+	if g.lists.results[fn] != nil {
+		var result ResultData
+		data.Result = &result
+		data.Returns = append(data.Returns, g.stringListResultData(fn, listLength, &result))
+		return g.errnoResult(data, stringParams), nil
+	}
+
+	if _, ok := g.owned[fn]; ok {
+		var result ResultData
+		ret, err := g.ownedResultData(fn, &result)
+		if err != nil {
+			return data, fmt.Errorf("%s: %w", fn.Name, err)
 		}
-		return "&ffi.TypePointer"
+		data.Result = &result
+		data.Returns = append(data.Returns, ret)
+		return g.errnoResult(data, stringParams), nil
 	}
-}
 
-func toGoName(name string) string {
-	if name == "" {
-		return ""
-	}
-
-	parts := strings.FieldsFunc(name, func(r rune) bool {
-		return r == '_'
-	})
-
-	var result strings.Builder
-	for _, part := range parts {
-		if len(part) > 0 {
-			result.WriteString(strings.ToUpper(string(part[0])))
-			if len(part) > 1 {
-				lower := strings.ToLower(part[1:])
-				for _, acronym := range []string{"id", "url", "api", "http", "json", "xml", "sql", "io", "ip", "tcp", "udp"} {
-					if strings.ToLower(part) == acronym {
-						result.Reset()
-						result.WriteString(strings.ToUpper(part))
-						break
-					}
-				}
-				if result.Len() > 0 && !strings.HasSuffix(result.String(), strings.ToUpper(part)) {
-					result.WriteString(lower)
-				}
-			}
+	m := g.mapType(fn.Result)
+	cType := m.GoType
+	if m.converts() {
+		cType = m.CType
+	}
+
+	result := ResultData{
+		Decl: fmt.Sprintf("var result %s", cType),
+		Arg:  "unsafe.Pointer(&result)",
+	}
+
+	value := "result"
+	switch {
+	case needsFFIArg(fn.Result):
+		result.Decl = "var result ffi.Arg"
+		value = fmt.Sprintf("%s(result)", cType)
+		if fn.Result.Underlying().Kind == sema.KindBool {
+			value = "result.Bool()"
 		}
+	case fn.Result.IsString():
+		result.Decl = "var resultPtr *byte"
+		result.Arg = "unsafe.Pointer(&resultPtr)"
+		value = "bytePtrToString(resultPtr)"
+	case g.wide.results[fn] != "":
+		h := wideHelpers[g.wide.results[fn]]
+		result.Decl = "var resultPtr " + h.ptrType
+		result.Arg = "unsafe.Pointer(&resultPtr)"
+		value = h.toString + "(resultPtr)"
+		m = Mapping{GoType: "string"}
+	}
+	if g.isConstructor(fn) && fn.Result.Underlying().Kind == sema.KindHandle {
+		m.FromC = g.names.wrapFunc(creates(fn, nil)) + "(%s, true)"
+	}
+	if m.converts() {
+		value = fmt.Sprintf(m.FromC, value)
 	}
 
-	return result.String()
-}
+	data.Result = &result
+	if g.errors == nil || !g.errors.funcs[fn] {
+		data.Returns = append(data.Returns, ReturnData{GoType: m.GoType, Value: value, Zero: zeroValue(fn.Result, m)})
+		return g.errnoResult(data, stringParams), nil
+	}
 
-func toLowerCamel(name string) string {
-	goName := toGoName(name)
-	if goName == "" {
-		return ""
+	// Status functions return an error instead of the status, and report
+	// strings that cannot be passed to C.
+	var zeros []string
+	for _, r := range data.Returns {
+		zeros = append(zeros, r.Zero)
 	}
-	runes := []rune(goName)
-	runes[0] = unicode.ToLower(runes[0])
-	return string(runes)
-}
+	if g.errors.nonNeg {
+		data.Returns = append(data.Returns, ReturnData{GoType: m.GoType, Value: value, Zero: zeroValue(fn.Result, m)})
+		zeros = append(zeros, data.Returns[len(data.Returns)-1].Zero)
+	}
+	reportStringErrors(&data, stringParams, zeros)
+	result.After = g.statusCheck(fn, value, data.Params, zeros)
+	data.Returns = append(data.Returns, ReturnData{GoType: "error", Value: "nil"})
 
-func toGoEnumName(enumName, valueName string) string {
-	return toGoName(valueName)
+	return data, nil
 }
 
-func isStringType(ct parser.CType) bool {
-	return ct.IsPointer && ct.Name == "char"
+// usesCStrings reports whether the generated code converts char strings,
+// which it does with the helpers of cstring.tmpl.
+func usesCStrings(module *sema.Module, lists *stringLists) bool {
+	if lists.used || hasVariadic(module.Functions) {
+		return true
+	}
+	for _, s := range module.Structs {
+		if slices.ContainsFunc(s.Fields, func(f *sema.Field) bool { return f.Type.IsString() }) {
+			return true
+		}
+	}
+	for _, fn := range module.Functions {
+		if fn.Result.IsString() || slices.ContainsFunc(fn.Params, func(p *sema.Param) bool { return p.Type.IsString() }) {
+			return true
+		}
+	}
+	return false
 }
 
-func isStringReturnType(ct parser.CType) bool {
-	return ct.IsPointer && ct.Name == "char"
+// sliceParamData fills in pd for the pointer of a slice parameter or a
+// buffer: the wrapper passes the slice's backing array, or nil for an empty
+// slice.
+func (g *Generator) sliceParamData(p *sema.Param, pd *ParamData) error {
+	pd.GoType = "[]byte"
+	if !p.Type.IsString() {
+		m := g.mapType(p.Type.Underlying().Elem)
+		if m.converts() {
+			return fmt.Errorf("elements of type %s need a conversion", m.GoType)
+		}
+		pd.GoType = "[]" + m.GoType
+	}
+	pd.Setup = fmt.Sprintf("var %sPtr unsafe.Pointer\nif len(%s) > 0 {\n\t%sPtr = unsafe.Pointer(&%s[0])\n}", pd.GoName, pd.GoName, pd.GoName, pd.GoName)
+	pd.Arg = fmt.Sprintf("unsafe.Pointer(&%sPtr)", pd.GoName)
+	return nil
 }
 
-func needsFFIArg(ct parser.CType) bool {
-	if ct.IsPointer || ct.Name == "void" {
-		return false
+// errnoResult adds the errno error to the results of data, if its function
+// reports failures through errno. Without an error result, strings that
+// cannot be passed to C panic.
+func (g *Generator) errnoResult(data FunctionData, stringParams []int) FunctionData {
+	if !data.Errno {
+		panicOnStringErrors(&data, stringParams)
+		return data
 	}
 
-	switch ct.Name {
-	case "int8_t", "uint8_t", "char", "bool":
-		return true
-	case "int16_t", "uint16_t", "short":
-		return true
-	case "int32_t", "uint32_t", "int":
-		return true
-	case "float", "double":
-		return false
-	default:
-		return false
+	var zeros []string
+	for _, r := range data.Returns {
+		zeros = append(zeros, r.Zero)
 	}
+	reportStringErrors(&data, stringParams, zeros)
+	data.Returns = append(data.Returns, ReturnData{GoType: "error", Value: "errnoError(errno)"})
+	return data
 }
 
-func isOpaqueHandle(ct parser.CType, header *parser.Header) bool {
-	if !ct.IsPointer {
-		return false
+// reportStringErrors makes the string parameters of data, which returns an
+// error after the results with the given zero values, return strings that
+// cannot be passed to C as errors.
+func reportStringErrors(data *FunctionData, stringParams []int, zeros []string) {
+	for _, i := range stringParams {
+		pd := &data.Params[i]
+		pd.Setup = strings.Replace(pd.Setup, ", _ :=", ", err :=", 1) + fmt.Sprintf("\nif err != nil {\n\treturn %s\n}", strings.Join(append(slices.Clone(zeros), "err"), ", "))
 	}
-	for _, s := range header.Structs {
-		if s.Name == ct.Name && s.IsOpaque {
-			return true
-		}
+}
+
+// panicOnStringErrors makes the string parameters of data, which has no
+// error result, panic on strings that cannot be passed to C, as
+// syscall.StringBytePtr does.
+func panicOnStringErrors(data *FunctionData, stringParams []int) {
+	for _, i := range stringParams {
+		pd := &data.Params[i]
+		pd.Setup = strings.Replace(pd.Setup, ", _ :=", ", err :=", 1) + fmt.Sprintf("\nif err != nil {\n\tpanic(%q + err.Error())\n}", data.Name+": "+pd.Name+": ")
 	}
-	return false
 }
 
-func isStructByValue(ct parser.CType, header *parser.Header) bool {
-	if ct.IsPointer {
-		return false
+// outParamData fills in pd for an out-parameter: the wrapper declares the
+// storage, passes a pointer to it and returns its value.
+func (g *Generator) outParamData(fn *sema.Function, p *sema.Param, pd *ParamData) ReturnData {
+	elem := p.Type.Underlying().Elem
+	m := g.mapType(elem)
+
+	pd.Out = true
+	pd.GoType = m.GoType
+
+	storage := pd.GoName
+	cType := m.GoType
+	if m.converts() {
+		storage = pd.GoName + "C"
+		cType = m.CType
 	}
-	for _, s := range header.Structs {
-		if s.Name == ct.Name && !s.IsOpaque {
-			return true
-		}
+	pd.Setup = fmt.Sprintf("var %s %s\n%sPtr := &%s", storage, cType, pd.GoName, storage)
+	pd.Arg = fmt.Sprintf("unsafe.Pointer(&%sPtr)", pd.GoName)
+
+	// Handles returned through a constructor's out-parameter are owned by
+	// the wrapper, like those returned by constructors.
+	if h := elem.Underlying(); h.Kind == sema.KindHandle && g.managed[h.Name] != nil && (g.isConstructor(fn) || lastWordIn(fn.Name, DefaultConstructorSuffixes)) {
+		m.FromC = g.names.wrapFunc(h.Name) + "(%s, true)"
+	}
+
+	value := storage
+	if m.converts() {
+		value = fmt.Sprintf(m.FromC, storage)
+	}
+	return ReturnData{GoType: m.GoType, Value: value, Zero: zeroValue(elem, m)}
+}
+
+// needsFFIArg reports whether a return value must be received through
+// ffi.Arg, which libffi requires for integers narrower than a register.
+func needsFFIArg(t *sema.Type) bool {
+	switch u := t.Underlying(); u.Kind {
+	case sema.KindBool, sema.KindInt, sema.KindEnum:
+		return u.Size < 8
 	}
 	return false
 }
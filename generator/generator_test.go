@@ -0,0 +1,744 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ardanlabs/ffi-converter/parser"
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// generate returns the files generated for header, by name.
+func generate(header string, opts Options) (map[string]string, error) {
+	h, err := parser.Parse(header)
+	if err != nil {
+		return nil, err
+	}
+	module, err := sema.Resolve(h)
+	if err != nil {
+		return nil, err
+	}
+	if opts.LibName == "" {
+		opts.LibName = "test"
+	}
+	g, err := New(module, opts)
+	if err != nil {
+		return nil, err
+	}
+	files, err := g.Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string)
+	for _, f := range files {
+		out[f.Name] = string(f.Content)
+	}
+	return out, nil
+}
+
+// mustGenerate is generate for headers expected to generate.
+func mustGenerate(t *testing.T, header string, opts Options) map[string]string {
+	t.Helper()
+	files, err := generate(header, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// wantContains checks that file holds every snippet.
+func wantContains(t *testing.T, files map[string]string, file string, snippets ...string) {
+	t.Helper()
+	src, ok := files[file]
+	if !ok {
+		t.Fatalf("%s not generated", file)
+	}
+	for _, s := range snippets {
+		if !strings.Contains(src, s) {
+			t.Errorf("%s does not contain %q:\n%s", file, s, src)
+		}
+	}
+}
+
+// wantError checks that header fails to generate with an error containing
+// msg.
+func wantError(t *testing.T, header string, opts Options, msg string) {
+	t.Helper()
+	_, err := generate(header, opts)
+	if err == nil || !strings.Contains(err.Error(), msg) {
+		t.Errorf("got error %v, want one containing %q", err, msg)
+	}
+}
+
+func TestPackedStructs(t *testing.T) {
+	const header = `
+#include <stdint.h>
+#pragma pack(push, 1)
+typedef struct { uint8_t tag; uint32_t value; } Pkt;
+#pragma pack(pop)
+`
+	files := mustGenerate(t, header+"void put(Pkt* p);", Options{})
+	wantContains(t, files, "types.go",
+		"type Pkt struct {\n\traw [5]byte\n}",
+		"func (s *Pkt) Value() uint32",
+		"copy(unsafe.Slice((*byte)(unsafe.Pointer(&v)), 4), s.raw[1:5])",
+		"func (s *Pkt) SetValue(v uint32)",
+	)
+	wantContains(t, files, "functions.go", "func Put(p *Pkt)")
+
+	wantError(t, header+"void put(Pkt p);", Options{}, "put: takes packed or over-aligned struct Pkt by value")
+	wantError(t, header+"Pkt get(void);", Options{}, "get: returns packed or over-aligned struct Pkt by value")
+
+	const aligned = `
+#include <stdint.h>
+typedef struct __attribute__((aligned(8))) { int32_t a; } Al8;
+`
+	files = mustGenerate(t, aligned+"void put(Al8* p);", Options{})
+	wantContains(t, files, "types.go", "_   [0]uint64")
+	wantError(t, aligned+"Al8 get(void);", Options{}, "get: returns packed or over-aligned struct Al8 by value")
+
+	wantError(t, "typedef struct { _Alignas(16) int a; } Al16;", Options{}, "struct Al16 is aligned to 16 bytes, but Go cannot align types to more than 8")
+}
+
+func TestHandlePairs(t *testing.T) {
+	const header = `
+typedef struct Db_s* Db;
+Db db_create(void);
+int db_open(const char* path, _Out_ Db* db);
+int db_close(Db db);
+int db_exec(Db db, const char* sql);
+Db db_current(void);
+`
+	files := mustGenerate(t, header, Options{DetectHandlePairs: true, HandleMethods: true, CleanupHandles: true})
+	wantContains(t, files, "functions.go",
+		"func DbCreate() *Db",
+		"return wrapDb(result, true)",
+		"func DbOpen(path string) (*Db, int32)",
+		"return wrapDb(dbC, true), int32(result)",
+		"func (db *Db) Exec(sql string) int32",
+		"runtime.KeepAlive(db)",
+		"func DbCurrent() *Db",
+		"return wrapDb(result, false)",
+	)
+	wantContains(t, files, "types.go", "func (v *Db) Close() error", "if v == nil || !v.owned {", "runtime.AddCleanup")
+
+	files = mustGenerate(t, header, Options{HandlePairs: []HandlePair{{Constructor: "db_open", Destructor: "db_close"}}})
+	wantContains(t, files, "functions.go", "return wrapDb(dbC, true), int32(result)")
+	if strings.Contains(files["functions.go"], "KeepAlive") {
+		t.Error("KeepAlive without CleanupHandles")
+	}
+
+	wantError(t, header, Options{HandlePairs: []HandlePair{{Constructor: "db_exec", Destructor: "db_close"}}},
+		"db_exec must return Db or take it as an out-parameter")
+}
+
+func TestOwnedResults(t *testing.T) {
+	const header = `
+char* dup(const char* s);
+char* name(int id);
+void name_free(char* s);
+`
+	files := mustGenerate(t, header, Options{OwnedResults: map[string]string{"dup": "free", "name": "name_free"}})
+	wantContains(t, files, "functions.go",
+		"func Dup(s string) string",
+		"func Name(id int32) string",
+		"func loadLibc() (ffi.Lib, error)",
+		`return ffi.Load("ucrtbase.dll")`,
+		"libc, err := loadLibc()",
+		`libc.Prep("free", &ffi.TypeVoid, &ffi.TypePointer)`,
+	)
+	if strings.Contains(files["functions.go"], "func NameFree") {
+		t.Error("generated a wrapper for the free function of owned results")
+	}
+
+	files = mustGenerate(t, header, Options{OwnedResults: map[string]string{"name": "name_free"}})
+	if strings.Contains(files["functions.go"], "loadLibc") {
+		t.Error("loadLibc without the C library's free")
+	}
+}
+
+func TestErrno(t *testing.T) {
+	files := mustGenerate(t, "int set_mode(int mode);", Options{Errno: []string{"set_*"}})
+	wantContains(t, files, "functions.go",
+		"func SetMode(mode int32) (int32, error)",
+		"libc, err := loadLibc()",
+		"if err := loadErrno(libc); err != nil",
+	)
+	wantContains(t, files, "errno.go", "func loadErrno(libc ffi.Lib) error", "libc.Prep(name, &ffi.TypePointer)")
+
+	const status = `
+typedef int rc_t;
+rc_t h_put(const char* s);
+`
+	files = mustGenerate(t, status, Options{Errno: []string{"h_*"}, Errors: &ErrorConvention{Status: "rc_t"}})
+	wantContains(t, files, "functions.go",
+		"func HPut(s string) error",
+		"errno := *errnoPtr",
+		`return &Error{Op: "h_put", Code: status, Errno: syscall.Errno(errno)}`,
+	)
+	wantContains(t, files, "types.go", "Errno   syscall.Errno", "return []error{e.Code, e.Errno}")
+}
+
+func TestMirrors(t *testing.T) {
+	const header = `
+#include <stddef.h>
+#include <stdint.h>
+typedef struct { const int32_t* values; size_t count; const char* title; } Series;
+int32_t series_sum(Series s);
+Series series_get(void);
+int series_put(const Series* s);
+`
+	files := mustGenerate(t, header, Options{DetectSlices: true, Errno: []string{"series_put"}})
+	wantContains(t, files, "functions.go",
+		"func SeriesSum(s Series) int32",
+		"sC, err := toCSeries(s, pinner)",
+		`panic("series_sum: s: " + err.Error())`,
+		"func SeriesPut(s *Series) (int32, error)",
+		"sC, err := toCSeriesPtr(s, pinner)\n\tif err != nil {\n\t\treturn 0, err\n\t}",
+		"func SeriesGet() Series",
+		"return fromCSeries(result)",
+	)
+	wantContains(t, files, "types.go",
+		"Values []int32",
+		"Title  string",
+		"type cSeries struct",
+		"pinner.Pin(p)",
+		`return c, fmt.Errorf("Series.title: %w", err)`,
+	)
+}
+
+func TestMirrorPointers(t *testing.T) {
+	const header = `
+typedef struct { const char* name; int count; } Item;
+void item_fill(Item* item);
+int item_count(const Item* item);
+`
+	files := mustGenerate(t, header, Options{})
+	wantContains(t, files, "functions.go",
+		"func ItemFill(item *Item)",
+		"if item != nil {\n\t\t*item = fromCItem(*itemC)\n\t}",
+		"func ItemCount(item *Item) int32",
+	)
+	if strings.Count(files["functions.go"], "fromCItem(") != 1 {
+		t.Error("copies back through a pointer to const")
+	}
+}
+
+func TestWideStrings(t *testing.T) {
+	const header = `
+#include <stddef.h>
+#include <stdint.h>
+typedef uint16_t WCHAR;
+typedef const WCHAR* LPCWSTR;
+size_t w_len(const wchar_t* s);
+const wchar_t* w_hello(void);
+const char16_t* u16_echo(const char16_t* s);
+const char32_t* u32_echo(const char32_t* s);
+size_t win_units(LPCWSTR s);
+const uint16_t* raw16(const uint16_t* s);
+`
+	files := mustGenerate(t, header, Options{})
+	wantContains(t, files, "functions.go",
+		"func WLen(s string) uint64",
+		"sPtr, err := wcharPtrFromString(s)",
+		"func WHello() string",
+		"return wcharPtrToString(resultPtr)",
+		"func U16Echo(s string) string",
+		"func U32Echo(s string) string",
+		"func WinUnits(s uintptr) uint64",
+		"func Raw16(s uintptr) uintptr",
+	)
+	wantContains(t, files, "widestring.go", "func wcharPtrFromString(", "func utf16PtrToString(", "func utf32PtrFromString(")
+
+	files = mustGenerate(t, header, Options{WideStrings: map[string]Encoding{
+		"LPCWSTR": EncodingUTF16,
+		"raw16.s": EncodingUTF16,
+		"raw16":   EncodingUTF16,
+	}})
+	wantContains(t, files, "functions.go",
+		"func WinUnits(s string) uint64",
+		"sPtr, err := utf16PtrFromString(s)",
+		"func Raw16(s string) string",
+	)
+
+	wantError(t, header, Options{WideStrings: map[string]Encoding{"raw16.s": EncodingUTF32}}, "wide string raw16.s: UTF-32 needs 32-bit units, not 16-bit")
+	wantError(t, header, Options{WideStrings: map[string]Encoding{"raw16.s": "utf8"}}, `wide string raw16.s: unsupported encoding "utf8"`)
+}
+
+func TestWCharTargets(t *testing.T) {
+	windows := Options{Targets: []string{"linux/amd64", "windows/amd64"}}
+	tests := []struct {
+		header string
+		err    string // empty when the header generates for windows
+	}{
+		{"void put(const wchar_t* s);", ""},
+		{"const wchar_t* get(void);", ""},
+		{"typedef struct { wchar_t* name; } Named; void put(Named n);", ""},
+		{"void put(wchar_t c);", "put: wchar_t has 16 bits on windows/amd64"},
+		{"wchar_t get(void);", "get: wchar_t has 16 bits"},
+		{"void fill(wchar_t* buf, int n);", "fill: wchar_t has 16 bits"},
+		{"typedef struct { wchar_t name[8]; } Named;", "Named.name: wchar_t has 16 bits"},
+	}
+
+	for _, tt := range tests {
+		if tt.err == "" {
+			mustGenerate(t, tt.header, windows)
+		} else {
+			wantError(t, tt.header, windows, tt.err)
+		}
+		mustGenerate(t, tt.header, Options{Targets: []string{"linux/amd64"}})
+	}
+}
+
+func TestOutParams(t *testing.T) {
+	const header = `
+#include <stdbool.h>
+int get_size(const char* name, int* width, int* height);
+void split(double v, _Out_ double* whole, _Out_ double* frac);
+bool parse(const char* s, int* value);
+`
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{Options{}, []string{
+			"func GetSize(name string, width uintptr, height uintptr) int32",
+			"func Split(v float64) (float64, float64)",
+			"func Parse(s string, value uintptr) bool",
+		}},
+		{Options{DetectOutParams: true, InParams: []string{"parse.value"}}, []string{
+			"func GetSize(name string) (int32, int32, int32)",
+			"func Split(v float64) (float64, float64)",
+			"func Parse(s string, value uintptr) bool",
+		}},
+		{Options{OutParams: []string{"get_size.width"}}, []string{
+			"func GetSize(name string, height uintptr) (int32, int32)",
+		}},
+	}
+
+	for _, tt := range tests {
+		files := mustGenerate(t, header, tt.opts)
+		wantContains(t, files, "functions.go", tt.want...)
+	}
+}
+
+func TestSlices(t *testing.T) {
+	const header = `
+#include <stddef.h>
+#include <stdint.h>
+double sum(const double* values, size_t count);
+void fill(_Out_writes_(n) int32_t* out, int n);
+void scale(_Inout_updates_(count) double* data, size_t count, double k);
+typedef struct { const int32_t* items; size_t num_items; } Bag;
+int32_t bag_total(Bag b);
+`
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{Options{}, []string{
+			"func Sum(values uintptr, count uint64) float64",
+			"func Fill(out []int32)",
+			"func Scale(data []float64, k float64)",
+		}},
+		{Options{DetectSlices: true}, []string{
+			"func Sum(values []float64) float64",
+			"func BagTotal(b Bag) int32",
+		}},
+		{Options{SliceParams: []SliceParam{{Function: "sum", Pointer: "values", Length: "count"}}}, []string{
+			"func Sum(values []float64) float64",
+		}},
+	}
+
+	for _, tt := range tests {
+		files := mustGenerate(t, header, tt.opts)
+		wantContains(t, files, "functions.go", tt.want...)
+	}
+
+	files := mustGenerate(t, header, Options{DetectSlices: true})
+	wantContains(t, files, "types.go", "Items []int32")
+}
+
+func TestFlexibleArrays(t *testing.T) {
+	const header = `
+#include <stdint.h>
+typedef struct { uint32_t total; uint8_t tag; double values[]; } Flex;
+typedef struct { uint16_t num_data; uint8_t data[]; } Bytes;
+`
+	files := mustGenerate(t, header, Options{})
+	wantContains(t, files, "types.go",
+		"func (s *Flex) Values(n int) []float64",
+		"unsafe.Add(unsafe.Pointer(s), 8)), n)",
+		"func (s *Bytes) Data() []uint8",
+		"unsafe.Add(unsafe.Pointer(s), 2)), s.NumData)",
+	)
+}
+
+func TestVariadic(t *testing.T) {
+	files := mustGenerate(t, "int log_msg(int level, const char* fmt, ...);", Options{})
+	wantContains(t, files, "functions.go",
+		"func LogMsg(level int32, fmt_ string, args ...any) int32",
+		`prepVariadic("log_msg", &ffi.TypeSint32, &ffi.TypeSint32, &ffi.TypePointer)`,
+	)
+	wantContains(t, files, "variadic.go", "func promoteVariadicArg(arg any)", "key = append(key, byte(t.Type), byte(t.Size))")
+}
+
+func TestComplex(t *testing.T) {
+	const header = `
+#include <complex.h>
+double complex cmul(double complex a, double complex b);
+float _Complex cconj(float _Complex z);
+`
+	files := mustGenerate(t, header, Options{Targets: []string{"linux/amd64", "darwin/arm64"}})
+	wantContains(t, files, "functions.go",
+		"func Cmul(a complex128, b complex128) complex128",
+		"func Cconj(z complex64) complex64",
+		`lib.Prep("cmul", &ffi.TypeComplexDouble, &ffi.TypeComplexDouble, &ffi.TypeComplexDouble)`,
+	)
+
+	wantError(t, header, Options{}, "cmul: double _Complex is not supported by libffi on windows/amd64, windows/arm64")
+}
+
+// mapWriter collects written files by name, in write order.
+type mapWriter struct {
+	names []string
+	files map[string]string
+}
+
+func (w *mapWriter) WriteFile(name string, data []byte) error {
+	w.names = append(w.names, name)
+	w.files[name] = string(data)
+	return nil
+}
+
+func TestGolden(t *testing.T) {
+	src, err := os.ReadFile("../testdata/calculator.h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parser.Parse(string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := sema.Resolve(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := New(module, Options{Package: "calculator", LibName: "calculator"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &mapWriter{files: make(map[string]string)}
+	if err := g.GenerateTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.IsSorted(w.names) {
+		t.Errorf("files written in order %v", w.names)
+	}
+
+	golden, err := filepath.Glob("../testdata/out/*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(golden) != len(w.files) {
+		t.Errorf("generated %v, want the files of testdata/out", w.names)
+	}
+	for _, path := range golden {
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.files[filepath.Base(path)]; got != string(want) {
+			t.Errorf("%s differs from testdata/out; regenerate it with go run . -header testdata/calculator.h -output testdata/out -package calculator -lib calculator", filepath.Base(path))
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	const header = "int add(int a, int b);"
+	files := mustGenerate(t, header, Options{Package: "calc", Layout: LayoutSingle})
+	if len(files) != 1 {
+		t.Errorf("generated %d files with the single layout, want 1", len(files))
+	}
+	wantContains(t, files, "calc.go", "package calc", "func Load(path string) error", "func Add(a int32, b int32) int32")
+
+	files = mustGenerate(t, header, Options{Exclude: []string{"a*"}})
+	if strings.Contains(files["functions.go"], "func Add") {
+		t.Error("generated an excluded function")
+	}
+
+	tests := []struct {
+		opts Options
+		want string
+	}{
+		{Options{Layout: "many"}, `unsupported layout "many"`},
+		{Options{Targets: []string{"plan9/386"}}, "unsupported target plan9/386"},
+		{Options{Include: []string{"["}}, `invalid filter pattern "["`},
+	}
+	for _, tt := range tests {
+		wantError(t, header, tt.opts, tt.want)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	const header = "int add(int a, int b);"
+	files := mustGenerate(t, header, Options{Templates: fstest.MapFS{
+		"function.tmpl": {Data: []byte("// {{.GoName}} calls {{.Name}}.\nfunc {{.GoName}}() {}")},
+	}})
+	wantContains(t, files, "functions.go", "// Add calls add.\nfunc Add() {}")
+
+	wantError(t, header, Options{Templates: fstest.MapFS{"functions.tmpl": {}}}, "unknown template functions.tmpl")
+	wantError(t, header, Options{Templates: fstest.MapFS{
+		"function.tmpl": {Data: []byte("func {{.GoName}}( {}")},
+	}}, "function add: generated invalid Go")
+}
+
+// durationMapper maps the millis_t typedef to time.Duration.
+type durationMapper struct{}
+
+func (durationMapper) MapType(t *sema.Type) (Mapping, bool) {
+	if t.Kind != sema.KindTypedef || t.Name != "millis_t" {
+		return Mapping{}, false
+	}
+	return Mapping{
+		GoType:  "time.Duration",
+		Imports: []string{"time"},
+		ToC:     "int64(%s / time.Millisecond)",
+		FromC:   "time.Duration(%s) * time.Millisecond",
+	}, true
+}
+
+func TestTypeMappers(t *testing.T) {
+	const header = `
+#include <stdint.h>
+typedef int64_t millis_t;
+typedef int32_t status_t;
+millis_t timeout(millis_t wait, status_t s);
+`
+	files := mustGenerate(t, header, Options{
+		TypeMappers: []TypeMapper{durationMapper{}},
+		Types:       map[string]GoType{"status_t": {Name: "Status"}},
+	})
+	wantContains(t, files, "functions.go",
+		`"time"`,
+		"func Timeout(wait time.Duration, s Status) time.Duration",
+		"waitC := int64(wait / time.Millisecond)",
+		"return time.Duration(result) * time.Millisecond",
+	)
+}
+
+// msMapper maps the ms_t typedef to time.Duration, converting results only.
+type msMapper struct{}
+
+func (msMapper) MapType(t *sema.Type) (Mapping, bool) {
+	if t.Kind != sema.KindTypedef || t.Name != "ms_t" {
+		return Mapping{}, false
+	}
+	return Mapping{
+		GoType:  "time.Duration",
+		Imports: []string{"time"},
+		FromC:   "time.Duration(%s) * time.Millisecond",
+	}, true
+}
+
+func TestTypeMapperDefaults(t *testing.T) {
+	const header = `
+#include <stdint.h>
+typedef int32_t ms_t;
+ms_t sleep_for(ms_t wait);
+`
+	files := mustGenerate(t, header, Options{TypeMappers: []TypeMapper{msMapper{}}})
+	wantContains(t, files, "functions.go",
+		"func SleepFor(wait time.Duration) time.Duration",
+		"waitC := int32(wait)",
+		"return time.Duration(int32(result)) * time.Millisecond",
+	)
+}
+
+func TestHandleMethods(t *testing.T) {
+	const header = `
+typedef struct Calc_s* Calc;
+Calc calc_new(void);
+int calc_add(Calc c, int a);
+void calc_reset(Calc c);
+int other(int x);
+`
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{Options{}, []string{"func CalcAdd(c Calc, a int32) int32", "func CalcReset(c Calc)"}},
+		{Options{HandleMethods: true}, []string{"func (c Calc) Add(a int32) int32", "func (c Calc) Reset()", "func Other(x int32) int32"}},
+		{Options{HandleMethods: true, KeepFunctions: true}, []string{
+			"func (c Calc) Add(a int32) int32",
+			"func CalcAdd(c Calc, a int32) int32 {\n\treturn c.Add(a)\n}",
+			"func CalcReset(c Calc) {\n\tc.Reset()\n}",
+		}},
+	}
+
+	for _, tt := range tests {
+		files := mustGenerate(t, header, tt.opts)
+		wantContains(t, files, "functions.go", tt.want...)
+	}
+
+	files := mustGenerate(t, header, Options{HandleMethods: true})
+	if strings.Contains(files["functions.go"], "func CalcAdd") {
+		t.Error("flat function generated without KeepFunctions")
+	}
+}
+
+func TestStringBuffers(t *testing.T) {
+	const header = `
+#include <stddef.h>
+int get_name(char* buf, size_t size);
+void set_label(char* label);
+void upper(char* s);
+`
+	files := mustGenerate(t, header, Options{})
+	wantContains(t, files, "functions.go",
+		"func GetName(buf []byte) int32",
+		"sizeC := uint64(len(buf))",
+		"func SetLabel(label []byte)",
+		"func Upper(s []byte)",
+	)
+
+	files = mustGenerate(t, header, Options{StringBuffers: true, StringParams: []string{"set_label.label"}})
+	wantContains(t, files, "functions.go",
+		"func GetNameString() (string, int32)",
+		"func SetLabel(label string)",
+		"func Upper(s []byte)",
+	)
+}
+
+func TestStatusErrors(t *testing.T) {
+	const header = `
+#include <stddef.h>
+typedef enum { CALC_OK, CALC_ERR_RANGE, CALC_ERR_NOMEM } calc_status;
+calc_status calc_div(int a, int b, _Out_ int* q);
+const char* calc_strerror(calc_status s);
+int posix_read(int fd, char* buf, size_t len);
+`
+	files := mustGenerate(t, header, Options{Errors: &ErrorConvention{Status: "calc_status", Message: "calc_strerror"}})
+	wantContains(t, files, "functions.go",
+		"func CalcDiv(a int32, b int32) (int32, error)",
+		`return 0, &Error{Op: "calc_div", Code: status}`,
+		"func PosixRead(fd int32, buf []byte) int32",
+	)
+	wantContains(t, files, "types.go",
+		"func (e *Error) Unwrap() error",
+		"func (c CalcStatus) Error() string {\n\treturn CalcStrerror(c)\n}",
+	)
+
+	files = mustGenerate(t, header, Options{Errors: &ErrorConvention{Status: "calc_status", Functions: []string{"posix_*"}, NonNegative: true}})
+	wantContains(t, files, "functions.go",
+		"func CalcDiv(a int32, b int32) (int32, CalcStatus, error)",
+		"func PosixRead(fd int32, buf []byte) (int32, error)",
+	)
+
+	tests := []struct {
+		conv ErrorConvention
+		want string
+	}{
+		{ErrorConvention{Status: "calc_stat"}, "status type calc_stat is not an enum or integer typedef"},
+		{ErrorConvention{Status: "calc_status", Success: []string{"CALC_FINE"}}, "success value CALC_FINE is not an integer or a value of calc_status"},
+		{ErrorConvention{Status: "calc_status", Message: "calc_div"}, "message function calc_div must return a string"},
+	}
+	for _, tt := range tests {
+		wantError(t, header, Options{Errors: &tt.conv}, tt.want)
+	}
+}
+
+func TestVerifyLayouts(t *testing.T) {
+	const header = `
+#include <stdint.h>
+typedef struct { uint8_t tag; double value; } Sample;
+#pragma pack(push, 1)
+typedef struct { uint8_t tag; uint32_t value; } Pkt;
+#pragma pack(pop)
+`
+	files := mustGenerate(t, header, Options{})
+	wantContains(t, files, "loader.go",
+		"if err := verifyLayouts(); err != nil",
+		"ffi.GetStructOffsets(ffi.DefaultAbi, &FFITypeSample, &offsets[0])",
+		`check("Sample size", unsafe.Sizeof(s), FFITypeSample.Size)`,
+		`check("Sample.value offset", unsafe.Offsetof(s.Value), offsets[1])`,
+	)
+	if strings.Contains(files["loader.go"], "Pkt") {
+		t.Error("verifies the layout of a packed struct, which has no libffi descriptor")
+	}
+
+	files = mustGenerate(t, "int add(int a, int b);", Options{})
+	if strings.Contains(files["loader.go"], "verifyLayouts") {
+		t.Error("verifyLayouts without structs")
+	}
+}
+
+func TestStringLists(t *testing.T) {
+	const header = `
+#include <stddef.h>
+#include <stdint.h>
+int32_t sl_load(const char** paths, size_t n);
+int32_t sl_argv(const char* const* argv);
+const char** sl_list(void);
+char** sl_dup(size_t* count);
+void sl_free_list(char** list);
+`
+	files := mustGenerate(t, header, Options{
+		StringLists: map[string]StringList{
+			"sl_load.paths": {Length: "n"},
+			"sl_argv.argv":  {},
+			"sl_list":       {},
+			"sl_dup":        {Length: "count", FreeStrings: true},
+		},
+		OwnedResults: map[string]string{"sl_dup": "sl_free_list"},
+	})
+	wantContains(t, files, "functions.go",
+		"func SlLoad(paths []string) int32",
+		"pathsPtr, err := stringArrayToC(paths, false, pinner)",
+		"func SlArgv(argv []string) int32",
+		"argvPtr, err := stringArrayToC(argv, true, pinner)",
+		"func SlList() []string",
+		"result := stringArrayFromC(resultPtr, -1)",
+		"func SlDup() []string",
+		"result := stringArrayFromC(resultPtr, int(count))",
+		"for _, p := range unsafe.Slice(resultPtr, len(result))",
+	)
+	wantContains(t, files, "stringlist.go", "func stringArrayToC(", "func stringArrayFromC(")
+}
+
+func TestCStrings(t *testing.T) {
+	const header = `
+typedef int rc_t;
+const char* version(void);
+int put(const char* s);
+rc_t put_checked(const char* s);
+size_t w_len(const wchar_t* s);
+`
+	files := mustGenerate(t, header, Options{Errors: &ErrorConvention{Status: "rc_t"}, Errno: []string{"put*"}, Targets: []string{"linux/amd64"}})
+	wantContains(t, files, "functions.go",
+		"func Version() string",
+		"func Put(s string) (int32, error)",
+		"func PutChecked(s string) error",
+		"sPtr, err := bytePtrFromString(s)",
+	)
+	wantContains(t, files, "cstring.go", "func bytePtrFromString(", "func bytePtrToString(")
+	for name, src := range files {
+		if strings.Contains(src, "golang.org/x/") {
+			t.Errorf("%s imports a package outside the standard library and ffi", name)
+		}
+	}
+
+	files = mustGenerate(t, "int put(const char* s);", Options{})
+	wantContains(t, files, "functions.go", `panic("put: s: " + err.Error())`)
+
+	files = mustGenerate(t, "int add(int a, int b);", Options{})
+	if _, ok := files["cstring.go"]; ok {
+		t.Error("cstring.go generated without strings")
+	}
+}
@@ -0,0 +1,147 @@
+package generator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"slices"
+	"strings"
+)
+
+// knownImports maps the package names generated code may reference to their
+// import paths.
+var knownImports = map[string]string{
+	"errors":   "errors",
+	"filepath": "path/filepath",
+	"fmt":      "fmt",
+	"log":      "log",
+	"reflect":  "reflect",
+	"runtime":  "runtime",
+	"slices":   "slices",
+	"sync":     "sync",
+	"syscall":  "syscall",
+	"atomic":   "sync/atomic",
+	"utf16":    "unicode/utf16",
+	"unsafe":   "unsafe",
+	"ffi":      "github.com/jupiterrider/ffi",
+}
+
+type goDecl struct {
+	name string
+	src  string
+}
+
+// goFile collects the declarations of one generated file. Each declaration
+// is parsed on its own so a malformed one can be reported by name, and the
+// file imports exactly the packages its declarations reference.
+type goFile struct {
+	pkg     string
+	header  string
+	decls   []goDecl
+	imports map[string]string
+}
+
+// newGoFile returns a file of package pkg. imports maps the package names
+// its declarations may reference to import paths.
+func newGoFile(pkg string, imports map[string]string) *goFile {
+	return &goFile{pkg: pkg, imports: imports}
+}
+
+// add appends a declaration. name identifies it in error messages.
+func (f *goFile) add(name, src string) {
+	f.decls = append(f.decls, goDecl{name: name, src: src})
+}
+
+func (f *goFile) render() ([]byte, error) {
+	used := make(map[string]bool)
+
+	for _, d := range f.decls {
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "", "package p;"+d.src, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, declError(d, err)
+		}
+
+		ast.Inspect(file, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if id, ok := sel.X.(*ast.Ident); ok {
+				if _, known := f.imports[id.Name]; known {
+					used[id.Name] = true
+				}
+			}
+			return true
+		})
+	}
+
+	var std, thirdParty []string
+	for name := range used {
+		path := f.imports[name]
+		if strings.Contains(path, ".") {
+			thirdParty = append(thirdParty, path)
+		} else {
+			std = append(std, path)
+		}
+	}
+	slices.Sort(std)
+	slices.Sort(thirdParty)
+
+	var buf bytes.Buffer
+	if header := strings.TrimSpace(f.header); header != "" {
+		fmt.Fprintf(&buf, "%s\n\n", header)
+	}
+	fmt.Fprintf(&buf, "package %s\n\n", f.pkg)
+
+	switch imports := append(std, thirdParty...); len(imports) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&buf, "import %q\n\n", imports[0])
+	default:
+		fmt.Fprintf(&buf, "import (\n")
+		for _, path := range std {
+			fmt.Fprintf(&buf, "\t%q\n", path)
+		}
+		if len(std) > 0 && len(thirdParty) > 0 {
+			fmt.Fprintf(&buf, "\n")
+		}
+		for _, path := range thirdParty {
+			fmt.Fprintf(&buf, "\t%q\n", path)
+		}
+		fmt.Fprintf(&buf, ")\n\n")
+	}
+
+	for _, d := range f.decls {
+		fmt.Fprintf(&buf, "%s\n\n", strings.TrimSpace(d.src))
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting file: %w", err)
+	}
+
+	return src, nil
+}
+
+// declError reports a parse error in a generated declaration together with
+// the offending line.
+func declError(d goDecl, err error) error {
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) == 0 {
+		return fmt.Errorf("%s: generated invalid Go: %w", d.name, err)
+	}
+
+	lines := strings.Split(d.src, "\n")
+	first := list[0]
+	if first.Pos.Line < 1 || first.Pos.Line > len(lines) {
+		return fmt.Errorf("%s: generated invalid Go: %s", d.name, first.Msg)
+	}
+
+	return fmt.Errorf("%s: generated invalid Go: %s in\n\t%s", d.name, first.Msg, strings.TrimSpace(lines[first.Pos.Line-1]))
+}
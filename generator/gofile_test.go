@@ -0,0 +1,48 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoFileRender(t *testing.T) {
+	f := newGoFile("p", knownImports)
+	f.header = "// Code generated by test. DO NOT EDIT."
+	f.add("a", "func a()   {\nfmt.Println(unsafe.Sizeof(0))\n}")
+	f.add("b", "var b ffi.Fun")
+
+	got, err := f.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `// Code generated by test. DO NOT EDIT.
+
+package p
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/jupiterrider/ffi"
+)
+
+func a() {
+	fmt.Println(unsafe.Sizeof(0))
+}
+
+var b ffi.Fun
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGoFileInvalidDecl(t *testing.T) {
+	f := newGoFile("p", knownImports)
+	f.add("function calc_add", "func CalcAdd(a int32 {\n}")
+
+	_, err := f.render()
+	if err == nil || !strings.Contains(err.Error(), "function calc_add: generated invalid Go") || !strings.Contains(err.Error(), "func CalcAdd(a int32 {") {
+		t.Errorf("got error %v, want one naming the declaration and its line", err)
+	}
+}
@@ -0,0 +1,198 @@
+package generator
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// HandlePair names the C functions that create and free an opaque handle.
+type HandlePair struct {
+	Constructor string
+	Destructor  string
+}
+
+// DefaultConstructorSuffixes and DefaultDestructorSuffixes are the last
+// words of the function names DetectHandlePairs looks for, as in calc_create
+// and calc_free.
+var (
+	DefaultConstructorSuffixes = []string{"create", "new", "open"}
+	DefaultDestructorSuffixes  = []string{"free", "destroy", "close"}
+)
+
+// managedHandle is an opaque handle wrapped in a Go type with Close.
+type managedHandle struct {
+	name         string // C name of the handle
+	constructors []*sema.Function
+	destructor   *sema.Function
+}
+
+// findHandlePairs returns the managed handles by C name: the configured
+// pairs, and with detect the handles that have constructors and exactly one
+// destructor named by the default suffixes. Constructors return the handle
+// or its only handle out-parameter of outs.
+func findHandlePairs(module *sema.Module, pairs []HandlePair, detect bool, outs map[*sema.Function][]bool) (map[string]*managedHandle, error) {
+	funcs := make(map[string]*sema.Function)
+	for _, fn := range module.Functions {
+		funcs[fn.Name] = fn
+	}
+
+	managed := make(map[string]*managedHandle)
+
+	for _, p := range pairs {
+		ctor, dtor := funcs[p.Constructor], funcs[p.Destructor]
+		if ctor == nil || dtor == nil {
+			return nil, fmt.Errorf("handle pair %s/%s: function not found", p.Constructor, p.Destructor)
+		}
+		name := destroys(dtor)
+		if name == "" {
+			return nil, fmt.Errorf("handle pair %s/%s: %s must take a single opaque handle", p.Constructor, p.Destructor, p.Destructor)
+		}
+		if creates(ctor, outs[ctor]) != name {
+			return nil, fmt.Errorf("handle pair %s/%s: %s must return %s or take it as an out-parameter", p.Constructor, p.Destructor, p.Constructor, name)
+		}
+
+		h := managed[name]
+		if h == nil {
+			h = &managedHandle{name: name, destructor: dtor}
+			managed[name] = h
+		}
+		if h.destructor != dtor {
+			return nil, fmt.Errorf("handle %s has two destructors, %s and %s", name, h.destructor.Name, dtor.Name)
+		}
+		if !slices.Contains(h.constructors, ctor) {
+			h.constructors = append(h.constructors, ctor)
+		}
+	}
+
+	if !detect {
+		return managed, nil
+	}
+
+	ctors := make(map[string][]*sema.Function)
+	dtors := make(map[string][]*sema.Function)
+	for _, fn := range module.Functions {
+		if name := creates(fn, outs[fn]); name != "" && lastWordIn(fn.Name, DefaultConstructorSuffixes) {
+			ctors[name] = append(ctors[name], fn)
+		}
+		if name := destroys(fn); name != "" && lastWordIn(fn.Name, DefaultDestructorSuffixes) {
+			dtors[name] = append(dtors[name], fn)
+		}
+	}
+
+	for _, s := range module.Structs {
+		if !s.Opaque || managed[s.Name] != nil {
+			continue
+		}
+		if len(ctors[s.Name]) == 0 || len(dtors[s.Name]) != 1 {
+			continue
+		}
+		managed[s.Name] = &managedHandle{
+			name:         s.Name,
+			constructors: ctors[s.Name],
+			destructor:   dtors[s.Name][0],
+		}
+	}
+
+	return managed, nil
+}
+
+// lastWordIn reports whether the last word of name, which must have more
+// than one, is one of suffixes.
+func lastWordIn(name string, suffixes []string) bool {
+	ws := words(name)
+	return len(ws) > 1 && slices.Contains(suffixes, strings.ToLower(ws[len(ws)-1]))
+}
+
+// creates returns the handle fn returns, if any: its result, or else its
+// only out-parameter pointing to a handle. outs flags the out-parameters.
+func creates(fn *sema.Function, outs []bool) string {
+	if u := fn.Result.Underlying(); u.Kind == sema.KindHandle {
+		return u.Name
+	}
+	var name string
+	for i, out := range outs {
+		if !out {
+			continue
+		}
+		if h := fn.Params[i].Type.Underlying().Elem.Underlying(); h.Kind == sema.KindHandle {
+			if name != "" {
+				return ""
+			}
+			name = h.Name
+		}
+	}
+	return name
+}
+
+// destroys returns the handle fn takes as its only parameter, if its result
+// is void or an integer status.
+func destroys(fn *sema.Function) string {
+	if len(fn.Params) != 1 || fn.Variadic {
+		return ""
+	}
+	switch fn.Result.Underlying().Kind {
+	case sema.KindVoid, sema.KindInt, sema.KindEnum:
+	default:
+		return ""
+	}
+	if u := fn.Params[0].Type.Underlying(); u.Kind == sema.KindHandle {
+		return u.Name
+	}
+	return ""
+}
+
+// handleMapper maps managed handles to pointers to their wrapper type.
+type handleMapper struct {
+	managed map[string]*managedHandle
+	names   *namer
+}
+
+func (hm handleMapper) MapType(t *sema.Type) (Mapping, bool) {
+	if t.Kind != sema.KindHandle || hm.managed[t.Name] == nil {
+		return Mapping{}, false
+	}
+
+	return Mapping{
+		GoType:  "*" + hm.names.typeName(t.Name),
+		FFIType: "&ffi.TypePointer",
+		CType:   "uintptr",
+		ToC:     "%s.Handle()",
+		FromC:   hm.names.wrapFunc(t.Name) + "(%s, false)",
+	}, true
+}
+
+func (g *Generator) isDestructor(fn *sema.Function) bool {
+	h := g.managed[destroys(fn)]
+	return h != nil && h.destructor == fn
+}
+
+func (g *Generator) isConstructor(fn *sema.Function) bool {
+	h := g.managed[creates(fn, g.outs[fn])]
+	return h != nil && slices.Contains(h.constructors, fn)
+}
+
+func (g *Generator) managedHandleData(s *sema.Struct) ManagedHandleData {
+	h := g.managed[s.Name]
+	dtor := h.destructor
+
+	data := ManagedHandleData{
+		GoName:        g.names.typeName(s.Name),
+		WrapFunc:      g.names.wrapFunc(s.Name),
+		FreeFunc:      g.names.freeFunc(s.Name),
+		Destructor:    dtor.Name,
+		DestructorVar: g.names.funcVar(dtor.Name),
+		Cleanup:       g.opts.CleanupHandles,
+		FlatFree:      g.names.funcName(dtor.Name),
+	}
+	if k := dtor.Result.Underlying().Kind; k == sema.KindInt || k == sema.KindEnum {
+		data.Status = g.defaultMapper.goType(dtor.Result)
+	}
+	if data.FlatFree != "" {
+		data.FlatFreeParam = g.names.paramNames(dtor, g.imports)[0]
+	}
+
+	return data
+}
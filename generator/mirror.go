@@ -0,0 +1,285 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// A natural struct with a string, a slice or a mirrored struct among its
+// fields has a Go layout that differs from C, so it is converted to an
+// unexported mirror with the C layout at the call boundary. Pointers in the
+// mirror refer to Go memory pinned for the duration of the call.
+type mirror struct {
+	slices map[int]int // index of each slice pointer field to its length field
+}
+
+// isLength reports whether field i is the length of a slice.
+func (m *mirror) isLength(i int) bool {
+	return slices.Contains(slices.Collect(maps.Values(m.slices)), i)
+}
+
+// findMirrors returns the structs converted to a mirror. Slice fields are
+// the SliceParams naming a struct and, with DetectSlices, pointers to
+// numbers, bools, enums or plain structs followed by a field named like a
+// length.
+func findMirrors(module *sema.Module, opts Options) (map[*sema.Struct]*mirror, error) {
+	structs := make(map[string]*sema.Struct)
+	for _, s := range module.Structs {
+		if !s.Opaque && s.Natural && s.FlexibleMember() == nil {
+			structs[s.Name] = s
+		}
+	}
+
+	fieldSlices := make(map[*sema.Struct]map[int]int)
+	var errs []error
+	add := func(s *sema.Struct, ptr, length int) error {
+		if err := checkSliceField(s.Fields[ptr].Type, s.Fields[length].Type); err != nil {
+			return err
+		}
+		if fieldSlices[s] == nil {
+			fieldSlices[s] = make(map[int]int)
+		}
+		if slices.Contains(slices.Collect(maps.Values(fieldSlices[s])), length) {
+			return fmt.Errorf("length %s is shared", s.Fields[length].Name)
+		}
+		fieldSlices[s][ptr] = length
+		return nil
+	}
+
+	for _, sp := range opts.SliceParams {
+		s := structs[sp.Function]
+		if s == nil {
+			continue
+		}
+		ptr, length := fieldIndex(s, sp.Pointer), fieldIndex(s, sp.Length)
+		if ptr < 0 || length < 0 || ptr == length {
+			errs = append(errs, fmt.Errorf("slice %s.%s: %s has no fields %s and %s", sp.Function, sp.Pointer, sp.Function, sp.Pointer, sp.Length))
+			continue
+		}
+		if err := add(s, ptr, length); err != nil {
+			errs = append(errs, fmt.Errorf("slice %s.%s: %w", sp.Function, sp.Pointer, err))
+		}
+	}
+
+	if opts.DetectSlices {
+		for _, s := range module.Structs {
+			if structs[s.Name] == nil {
+				continue
+			}
+			for i, f := range s.Fields[:max(len(s.Fields)-1, 0)] {
+				next := s.Fields[i+1]
+				if _, ok := fieldSlices[s][i]; ok || f.Type.IsString() || !isLength(&sema.Param{Name: next.Name, Type: next.Type}) {
+					continue
+				}
+				_ = add(s, i, i+1)
+			}
+		}
+	}
+
+	found := make(map[*sema.Struct]*mirror)
+	for changed := true; changed; {
+		changed = false
+		for _, s := range module.Structs {
+			if structs[s.Name] == nil || found[s] != nil {
+				continue
+			}
+			if fieldSlices[s] != nil || slices.ContainsFunc(s.Fields, func(f *sema.Field) bool { return needsMirror(f.Type, found) }) {
+				found[s] = &mirror{slices: fieldSlices[s]}
+				changed = true
+			}
+		}
+	}
+
+	return found, errors.Join(errs...)
+}
+
+// needsMirror reports whether a field of type t makes its struct mirrored:
+// t is a string, or a mirrored struct or an array of them.
+func needsMirror(t *sema.Type, found map[*sema.Struct]*mirror) bool {
+	if t.IsString() {
+		return true
+	}
+	u := t.Underlying()
+	if u.Kind == sema.KindArray {
+		u = u.Elem.Underlying()
+	}
+	return u.Kind == sema.KindStruct && found[u.Struct] != nil
+}
+
+// checkSliceField reports why ptr and length cannot be a slice field. Slice
+// elements must be the same in Go and C.
+func checkSliceField(ptr, length *sema.Type) error {
+	if err := checkSliceParam(ptr, length); err != nil {
+		return err
+	}
+	if !ptr.IsString() && !isPlain(ptr.Underlying().Elem) {
+		return fmt.Errorf("elements must be numbers, bools, enums or structs of them")
+	}
+	return nil
+}
+
+// isPlain reports whether t holds no pointers, so its Go and C layouts
+// agree.
+func isPlain(t *sema.Type) bool {
+	switch u := t.Underlying(); u.Kind {
+	case sema.KindBool, sema.KindInt, sema.KindFloat, sema.KindEnum:
+		return true
+	case sema.KindArray:
+		return isPlain(u.Elem)
+	case sema.KindStruct:
+		return u.Struct.Natural && !u.Struct.Opaque && !slices.ContainsFunc(u.Struct.Fields, func(f *sema.Field) bool { return !isPlain(f.Type) })
+	}
+	return false
+}
+
+func fieldIndex(s *sema.Struct, name string) int {
+	return slices.IndexFunc(s.Fields, func(f *sema.Field) bool { return f.Name == name })
+}
+
+// mirrorOf returns the mirrored struct t is, if any.
+func (g *Generator) mirrorOf(t *sema.Type) *sema.Struct {
+	if u := t.Underlying(); u.Kind == sema.KindStruct && g.mirrors[u.Struct] != nil {
+		return u.Struct
+	}
+	return nil
+}
+
+// mirrorPtrOf returns the mirrored struct t points to, if any.
+func (g *Generator) mirrorPtrOf(t *sema.Type) *sema.Struct {
+	if u := t.Underlying(); u.Kind == sema.KindPointer && !t.IsString() {
+		return g.mirrorOf(u.Elem)
+	}
+	return nil
+}
+
+// mirrorMapper maps mirrored structs, and pointers to them, to the Go struct
+// converted to and from the mirror. Pointers are converted to a pointer to a
+// copy, which wrappers copy back after the call unless it points to const.
+type mirrorMapper struct {
+	g *Generator
+}
+
+func (mm mirrorMapper) MapType(t *sema.Type) (Mapping, bool) {
+	names := mm.g.names
+	if t.Kind == sema.KindStruct && mm.g.mirrors[t.Struct] != nil {
+		return Mapping{
+			GoType: names.typeName(t.Name),
+			CType:  names.mirrorType(t.Name),
+			ToC:    names.toCFunc(t.Name) + "(%s, pinner)",
+			FromC:  names.fromCFunc(t.Name) + "(%s)",
+		}, true
+	}
+	if s := mm.g.mirrorPtrOf(t); s != nil && t.Kind == sema.KindPointer {
+		return Mapping{
+			GoType:  "*" + names.typeName(s.Name),
+			FFIType: "&ffi.TypePointer",
+			CType:   "*" + names.mirrorType(s.Name),
+			ToC:     names.toCPtrFunc(s.Name) + "(%s, pinner)",
+			FromC:   names.fromCPtrFunc(s.Name) + "(%s)",
+		}, true
+	}
+	return Mapping{}, false
+}
+
+// convertsToMirror reports whether m, the mapping of t, converts it to a
+// mirror or a pointer to one, which pins the Go memory it refers to.
+func (g *Generator) convertsToMirror(t *sema.Type, m Mapping) bool {
+	s := g.mirrorOf(t)
+	if s == nil {
+		s = g.mirrorPtrOf(t)
+	}
+	return s != nil && strings.TrimPrefix(m.CType, "*") == g.names.mirrorType(s.Name)
+}
+
+// findMirrorPtrs records the mirrors functions take or return by pointer,
+// which need the pointer conversions. Out-parameters and slices are
+// converted by element, and owned results cannot be converted.
+func (g *Generator) findMirrorPtrs() {
+	for _, fn := range g.module.Functions {
+		for i, p := range fn.Params {
+			if g.outs[fn] != nil && g.outs[fn][i] || isSliceParam(g.slices[fn], i) {
+				continue
+			}
+			if s := g.mirrorPtrOf(p.Type); s != nil {
+				g.mirrorPtrs[s] = true
+			}
+		}
+		if _, ok := g.owned[fn]; ok {
+			continue
+		}
+		if s := g.mirrorPtrOf(fn.Result); s != nil {
+			g.mirrorPtrs[s] = true
+		}
+	}
+}
+
+// mirrorData returns the mirror of s, given the data of its fields with
+// their C types, and the fields of the Go struct.
+func (g *Generator) mirrorData(s *sema.Struct, m *mirror, fields []FieldData) (*MirrorData, []FieldData) {
+	data := &MirrorData{
+		GoName: g.names.mirrorType(s.Name),
+		ToC:    g.names.toCFunc(s.Name),
+		FromC:  g.names.fromCFunc(s.Name),
+	}
+	if g.mirrorPtrs[s] {
+		data.ToCPtr = g.names.toCPtrFunc(s.Name)
+		data.FromCPtr = g.names.fromCPtrFunc(s.Name)
+	}
+
+	var goFields []FieldData
+	for i, cf := range fields {
+		t := s.Fields[i].Type
+		gf := cf
+		name := cf.GoName
+
+		switch length, isSlice := m.slices[i]; {
+		case isSlice:
+			elem := "byte"
+			if !t.IsString() {
+				elem = g.fieldType(t.Underlying().Elem)
+			}
+			l := fields[length]
+			gf.GoType = "[]" + elem
+			cf.GoType = "*" + elem
+			cf.ToC = fmt.Sprintf("if len(s.%[1]s) > 0 {\n\tpinner.Pin(&s.%[1]s[0])\n\tc.%[1]s = &s.%[1]s[0]\n}\nc.%[2]s = %[3]s(len(s.%[1]s))", name, l.GoName, l.GoType)
+			cf.FromC = fmt.Sprintf("if c.%[1]s != nil {\n\ts.%[1]s = slices.Clone(unsafe.Slice(c.%[1]s, c.%[2]s))\n}", name, l.GoName)
+		case m.isLength(i):
+		case t.IsString():
+			gf.GoType = "string"
+			cf.GoType = "*byte"
+			cf.ToC = fmt.Sprintf("if p, err := bytePtrFromString(s.%[1]s); err != nil {\n\treturn c, fmt.Errorf(\"%[2]s.%[3]s: %%w\", err)\n} else {\n\tpinner.Pin(p)\n\tc.%[1]s = p\n}", name, s.Name, s.Fields[i].Name)
+			cf.FromC = fmt.Sprintf("s.%[1]s = bytePtrToString(c.%[1]s)", name)
+		case g.mirrorOf(t) != nil:
+			ms := g.mirrorOf(t)
+			gf.GoType = g.names.typeName(ms.Name)
+			cf.GoType = g.names.mirrorType(ms.Name)
+			cf.ToC = fmt.Sprintf("if m, err := %[2]s(s.%[1]s, pinner); err != nil {\n\treturn c, err\n} else {\n\tc.%[1]s = m\n}", name, g.names.toCFunc(ms.Name))
+			cf.FromC = fmt.Sprintf("s.%[1]s = %[2]s(c.%[1]s)", name, g.names.fromCFunc(ms.Name))
+		case t.Underlying().Kind == sema.KindArray && g.mirrorOf(t.Underlying().Elem) != nil:
+			ms := g.mirrorOf(t.Underlying().Elem)
+			n := t.Underlying().Len
+			gf.GoType = fmt.Sprintf("[%d]%s", n, g.names.typeName(ms.Name))
+			cf.GoType = fmt.Sprintf("[%d]%s", n, g.names.mirrorType(ms.Name))
+			cf.ToC = fmt.Sprintf("for i := range s.%[1]s {\n\tm, err := %[2]s(s.%[1]s[i], pinner)\n\tif err != nil {\n\t\treturn c, err\n\t}\n\tc.%[1]s[i] = m\n}", name, g.names.toCFunc(ms.Name))
+			cf.FromC = fmt.Sprintf("for i := range c.%[1]s {\n\ts.%[1]s[i] = %[2]s(c.%[1]s[i])\n}", name, g.names.fromCFunc(ms.Name))
+		case strings.HasPrefix(cf.GoType, "*"):
+			cf.ToC = fmt.Sprintf("c.%[1]s = s.%[1]s\nif s.%[1]s != nil {\n\tpinner.Pin(s.%[1]s)\n}", name)
+			cf.FromC = fmt.Sprintf("s.%[1]s = c.%[1]s", name)
+		default:
+			cf.ToC = fmt.Sprintf("c.%[1]s = s.%[1]s", name)
+			cf.FromC = fmt.Sprintf("s.%[1]s = c.%[1]s", name)
+		}
+
+		data.Fields = append(data.Fields, cf)
+		if !m.isLength(i) {
+			goFields = append(goFields, gf)
+		}
+	}
+
+	return data, goFields
+}
@@ -0,0 +1,529 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"go/types"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// DefaultAcronyms are the words written in upper case when
+// NamingOptions.Acronyms is nil.
+var DefaultAcronyms = []string{"api", "http", "id", "io", "ip", "json", "sql", "tcp", "udp", "url", "xml"}
+
+// Collision selects what happens when two C declarations map to the same Go
+// identifier.
+type Collision string
+
+const (
+	CollisionError  Collision = "error"  // fail naming both declarations
+	CollisionSuffix Collision = "suffix" // number the later ones: Foo, Foo2, ...
+)
+
+type NamingOptions struct {
+	// Renames maps C declaration names (functions, structs, enums and enum
+	// values) to the Go identifiers to use instead of the derived ones.
+	Renames map[string]string
+
+	// Acronyms are words written in upper case, such as "id" in get_user_id.
+	// Nil uses DefaultAcronyms.
+	Acronyms []string
+
+	// StripPrefixes are removed from the start of declaration names, so
+	// "calc_" turns calc_add into Add. A prefix only matches whole words.
+	StripPrefixes []string
+
+	// TrimEnumPrefix removes the words all values of an enum start with, so
+	// COLOR_RED and COLOR_GREEN become Red and Green.
+	TrimEnumPrefix bool
+
+	// QualifyEnumValues prepends the Go name of the enum to its values.
+	QualifyEnumValues bool
+
+	OnCollision Collision // defaults to CollisionError
+}
+
+// namer assigns the Go identifier of every generated declaration up front,
+// so collisions are found before any code is written.
+type namer struct {
+	opts            NamingOptions
+	handleMethods   bool
+	useLibcFree     bool
+	useErrno        bool
+	useCStrings     bool
+	useStringArrays bool
+	useWideStrings  bool
+	keepFunctions   bool
+	acronyms        map[string]bool
+	names           map[string]string // "<kind> <C name>" to Go name
+	unexported      map[string]bool   // package-level names parameters must not shadow
+	errs            []error
+}
+
+func newNamer(opts Options) *namer {
+	n := namer{
+		opts:          opts.Naming,
+		handleMethods: opts.HandleMethods,
+		useLibcFree:   slices.Contains(slices.Collect(maps.Values(opts.OwnedResults)), libcFree),
+		useErrno:      len(opts.Errno) > 0,
+		keepFunctions: opts.KeepFunctions,
+		acronyms:      make(map[string]bool),
+		names:         make(map[string]string),
+		unexported:    make(map[string]bool),
+	}
+
+	acronyms := opts.Naming.Acronyms
+	if acronyms == nil {
+		acronyms = DefaultAcronyms
+	}
+	for _, a := range acronyms {
+		n.acronyms[strings.ToLower(a)] = true
+	}
+
+	return &n
+}
+
+// reservedNames are the package-level identifiers of the loader and the
+// variadic support code.
+var reservedNames = []string{"lib", "Load", "getLibraryPath", "loadFuncs", "verifyLayouts"}
+
+var reservedVariadicNames = []string{"variadicFun", "prepVariadic", "promoteVariadicArg"}
+
+// reservedErrnoNames are declared when functions report errors through errno.
+var reservedErrnoNames = []string{"errnoLocationFunc", "errnoLocation", "errnoError", "loadErrno"}
+
+// reservedCStringNames are declared when the generated code converts char
+// strings.
+var reservedCStringNames = []string{"bytePtrFromString", "bytePtrToString", "byteSliceToString"}
+
+// reservedStringArrayNames are declared when functions take or return string
+// lists.
+var reservedStringArrayNames = []string{"stringArrayToC", "stringArrayFromC"}
+
+// reservedWideStringNames are declared when functions take or return wide
+// strings.
+var reservedWideStringNames = []string{
+	"utf16PtrFromString", "utf16PtrToString",
+	"utf32PtrFromString", "utf32PtrToString",
+	"wcharPtrFromString", "wcharPtrToString",
+}
+
+// assign names every declaration of module. managed are the handles wrapped
+// in a Go type with Close.
+func (n *namer) assign(module *sema.Module, managed map[string]*managedHandle, buffered map[*sema.Function]int, conv *errorConvention, mirrors map[*sema.Struct]*mirror) error {
+	scope := make(map[string]string)
+
+	reserved := reservedNames
+	if hasVariadic(module.Functions) {
+		reserved = append(slices.Clone(reserved), reservedVariadicNames...)
+	}
+	if n.useErrno {
+		reserved = append(slices.Clone(reserved), reservedErrnoNames...)
+	}
+	if n.useErrno || n.useLibcFree {
+		reserved = append(slices.Clone(reserved), "loadLibc")
+	}
+	if n.useCStrings {
+		reserved = append(slices.Clone(reserved), reservedCStringNames...)
+	}
+	if n.useStringArrays {
+		reserved = append(slices.Clone(reserved), reservedStringArrayNames...)
+	}
+	if n.useWideStrings {
+		reserved = append(slices.Clone(reserved), reservedWideStringNames...)
+	}
+	for _, name := range reserved {
+		scope[name] = "the generated loader"
+	}
+
+	for _, s := range module.Structs {
+		n.declare(scope, "type "+s.Name, n.declName(s.Name))
+	}
+	for _, e := range module.Enums {
+		n.declare(scope, "type "+e.Name, n.declName(e.Name))
+	}
+	if conv != nil {
+		n.declare(scope, "error type", "Error")
+		if conv.enum == nil {
+			n.declare(scope, "status type", n.statusName(conv.status))
+		}
+	}
+	for _, e := range module.Enums {
+		n.nameEnumValues(scope, e)
+	}
+	methods := make(map[string]map[string]string)
+	for _, s := range module.Structs {
+		if managed[s.Name] == nil {
+			continue
+		}
+		methods[s.Name] = map[string]string{
+			"Close":  "method Close",
+			"Handle": "method Handle",
+		}
+		typeName := n.typeName(s.Name)
+		n.declare(scope, "wrap "+s.Name, "wrap"+typeName)
+		n.declare(scope, "free "+s.Name, "free"+typeName)
+	}
+
+	for _, fn := range module.Functions {
+		// The destructor of a managed handle is called by Close.
+		isDestructor := false
+		if h := managed[destroys(fn)]; h != nil && h.destructor == fn {
+			isDestructor = true
+		}
+
+		if handle := n.receiver(fn); handle != "" {
+			if !isDestructor {
+				if methods[handle] == nil {
+					methods[handle] = make(map[string]string)
+				}
+				method := n.declare(methods[handle], "method "+fn.Name, n.methodName(fn.Name, handle))
+				if _, ok := buffered[fn]; ok {
+					n.declare(methods[handle], "string "+fn.Name, method+"String")
+				}
+			}
+			if !n.keepFunctions {
+				continue
+			}
+		}
+		name := n.declare(scope, "func "+fn.Name, n.declName(fn.Name))
+		if _, ok := buffered[fn]; ok && n.names["string "+fn.Name] == "" {
+			n.declare(scope, "string "+fn.Name, name+"String")
+		}
+	}
+	for _, s := range module.Structs {
+		if !s.Opaque && s.Natural {
+			n.declare(scope, "ffitype "+s.Name, "FFIType"+n.typeName(s.Name))
+		}
+	}
+	// Function variables follow renames, which may be resolving a
+	// collision between the C names.
+	for _, fn := range module.Functions {
+		name := fn.Name
+		if rename, ok := n.opts.Renames[fn.Name]; ok {
+			name = rename
+		}
+		n.declare(scope, "funcvar "+fn.Name, n.lowerCamel(name)+"Func")
+	}
+	for _, s := range module.Structs {
+		if mirrors[s] == nil {
+			continue
+		}
+		typeName := n.typeName(s.Name)
+		n.declare(scope, "mirror "+s.Name, "c"+typeName)
+		n.declare(scope, "toc "+s.Name, "toC"+typeName)
+		n.declare(scope, "fromc "+s.Name, "fromC"+typeName)
+		n.declare(scope, "toc pointer "+s.Name, "toC"+typeName+"Ptr")
+		n.declare(scope, "fromc pointer "+s.Name, "fromC"+typeName+"Ptr")
+	}
+	if n.useLibcFree {
+		n.declare(scope, "the C library's free", "libcFree")
+	}
+
+	for name := range scope {
+		if !token.IsExported(name) {
+			n.unexported[name] = true
+		}
+	}
+
+	for _, s := range module.Structs {
+		n.nameFields(s)
+	}
+
+	return errors.Join(n.errs...)
+}
+
+func (n *namer) nameEnumValues(scope map[string]string, e *sema.Enum) {
+	values := make([][]string, len(e.Values))
+	for i, v := range e.Values {
+		values[i] = n.strip(words(v.Name))
+	}
+
+	if n.opts.TrimEnumPrefix && len(values) > 0 {
+		common := len(values[0])
+		if len(values) == 1 {
+			common = commonPrefix(values[0], n.strip(words(e.Name)))
+		}
+		for _, ws := range values[1:] {
+			common = min(common, commonPrefix(values[0], ws))
+		}
+
+		// Keep at least one word, and never leave a name starting with a
+		// digit unless the enum name goes in front of it.
+		for common > 0 && slices.ContainsFunc(values, func(ws []string) bool {
+			return common >= len(ws) || !n.opts.QualifyEnumValues && unicode.IsDigit(rune(ws[common][0]))
+		}) {
+			common--
+		}
+		for i := range values {
+			values[i] = values[i][common:]
+		}
+	}
+
+	for i, v := range e.Values {
+		goName := n.exported(values[i])
+		if n.opts.QualifyEnumValues {
+			goName = n.typeName(e.Name) + n.camel(values[i])
+		}
+		if rename, ok := n.opts.Renames[v.Name]; ok {
+			goName = rename
+		}
+		n.declare(scope, "value "+v.Name, goName)
+	}
+}
+
+// nameFields names the fields of s and checks them against the methods the
+// generated type has.
+func (n *namer) nameFields(s *sema.Struct) {
+	scope := make(map[string]string)
+	label := func(f *sema.Field) string {
+		return "field " + s.Name + "." + f.Name
+	}
+
+	if !s.Natural {
+		scope["Bytes"] = "method Bytes"
+	}
+
+	for _, f := range s.Fields {
+		goName := n.goName(f.Name)
+		if f.Type.Flexible || s.Natural {
+			n.declare(scope, label(f), goName)
+			continue
+		}
+		goName = n.declare(scope, label(f), goName)
+		n.declare(scope, "setter "+s.Name+"."+f.Name, "Set"+goName)
+	}
+}
+
+// declare records goName for key, disambiguating or reporting a collision
+// with a name already in scope. It returns the name assigned.
+func (n *namer) declare(scope map[string]string, key, goName string) string {
+	if owner, ok := scope[goName]; ok {
+		if n.opts.OnCollision != CollisionSuffix {
+			n.errs = append(n.errs, fmt.Errorf("%s and %s both map to the Go name %s; rename one of them", owner, key, goName))
+		} else {
+			base := goName
+			for i := 2; ; i++ {
+				goName = fmt.Sprintf("%s%d", base, i)
+				if _, ok := scope[goName]; !ok {
+					break
+				}
+			}
+		}
+	}
+
+	scope[goName] = key
+	n.names[key] = goName
+
+	return goName
+}
+
+// statusName returns the Go name of an integer status typedef, or Status
+// for plain integers.
+func (n *namer) statusName(typedef string) string {
+	if typedef == "" {
+		return "Status"
+	}
+	return n.declName(typedef)
+}
+
+// declName derives the Go name of a package-level declaration.
+func (n *namer) declName(name string) string {
+	if rename, ok := n.opts.Renames[name]; ok {
+		return rename
+	}
+	return n.exported(n.strip(words(name)))
+}
+
+// receiver returns the C name of the handle fn is a method of, if any.
+func (n *namer) receiver(fn *sema.Function) string {
+	if !n.handleMethods || len(fn.Params) == 0 {
+		return ""
+	}
+	if u := fn.Params[0].Type.Underlying(); u.Kind == sema.KindHandle {
+		return u.Name
+	}
+	return ""
+}
+
+// methodName derives the name of fn as a method of handle by removing the
+// words of the handle's name, so calc_add on Calc becomes Add.
+func (n *namer) methodName(name, handle string) string {
+	if rename, ok := n.opts.Renames[name]; ok {
+		return rename
+	}
+
+	ws := n.strip(words(name))
+	hw := n.strip(words(handle))
+	if len(ws) > len(hw) && commonPrefix(ws, hw) == len(hw) {
+		ws = ws[len(hw):]
+	}
+
+	return n.exported(ws)
+}
+
+func (n *namer) typeName(name string) string {
+	if goName, ok := n.names["type "+name]; ok {
+		return goName
+	}
+	return n.declName(name)
+}
+
+func (n *namer) valueName(name string) string  { return n.names["value "+name] }
+func (n *namer) funcName(name string) string   { return n.names["func "+name] }
+func (n *namer) stringFunc(name string) string { return n.names["string "+name] }
+func (n *namer) libcFreeVar() string           { return n.names["the C library's free"] }
+func (n *namer) errorType() string             { return n.names["error type"] }
+func (n *namer) statusType() string            { return n.names["status type"] }
+func (n *namer) funcVar(name string) string    { return n.names["funcvar "+name] }
+func (n *namer) ffiTypeVar(name string) string { return n.names["ffitype "+name] }
+func (n *namer) fieldName(s, f string) string  { return n.names["field "+s+"."+f] }
+func (n *namer) setterName(s, f string) string { return n.names["setter "+s+"."+f] }
+
+func (n *namer) mirrorType(s string) string   { return n.names["mirror "+s] }
+func (n *namer) toCFunc(s string) string      { return n.names["toc "+s] }
+func (n *namer) fromCFunc(s string) string    { return n.names["fromc "+s] }
+func (n *namer) toCPtrFunc(s string) string   { return n.names["toc pointer "+s] }
+func (n *namer) fromCPtrFunc(s string) string { return n.names["fromc pointer "+s] }
+
+func (n *namer) wrapFunc(handle string) string { return n.names["wrap "+handle] }
+func (n *namer) freeFunc(handle string) string { return n.names["free "+handle] }
+
+func (n *namer) methodOf(name string) (string, bool) {
+	m, ok := n.names["method "+name]
+	return m, ok
+}
+
+// wrapperLocals are the variables generated wrappers declare themselves.
+var wrapperLocals = []string{"result", "resultPtr", "err", "args", "errno", "errnoPtr", "pinner"}
+
+// paramNames returns the Go names of the parameters of fn. Unnamed
+// parameters are numbered, and names that are Go keywords or would shadow a
+// predeclared identifier, an imported package, a package-level name or a
+// wrapper local get an underscore appended. Every name is chosen so that its
+// Ptr and C suffixed forms, which wrappers use for converted values, are
+// free as well.
+func (n *namer) paramNames(fn *sema.Function, imports map[string]string) []string {
+	taken := make(map[string]bool)
+	for _, name := range wrapperLocals {
+		taken[name] = true
+	}
+
+	reserved := func(name string) bool {
+		_, imported := imports[name]
+		return token.IsKeyword(name) || types.Universe.Lookup(name) != nil || imported || n.unexported[name]
+	}
+	free := func(name string) bool {
+		return !taken[name] && !taken[name+"Ptr"] && !taken[name+"C"]
+	}
+
+	names := make([]string, len(fn.Params))
+	for i, p := range fn.Params {
+		base := n.lowerCamel(p.Name)
+		if base == "" {
+			base = fmt.Sprintf("arg%d", i+1)
+		}
+		if reserved(base) {
+			base += "_"
+		}
+
+		name := base
+		for j := 2; !free(name); j++ {
+			name = fmt.Sprintf("%s%d", base, j)
+		}
+
+		taken[name], taken[name+"Ptr"], taken[name+"C"] = true, true, true
+		names[i] = name
+	}
+
+	return names
+}
+
+// goName converts a C identifier to an exported Go identifier.
+func (n *namer) goName(name string) string {
+	return n.exported(words(name))
+}
+
+// lowerCamel converts a C identifier to an unexported Go identifier.
+func (n *namer) lowerCamel(name string) string {
+	ws := words(name)
+	if len(ws) == 0 {
+		return ""
+	}
+	return strings.ToLower(ws[0]) + n.camel(ws[1:])
+}
+
+// exported is camel for identifiers that must be exported and valid, which
+// rules out empty names and names starting with a digit.
+func (n *namer) exported(ws []string) string {
+	if len(ws) == 0 || unicode.IsDigit(rune(ws[0][0])) {
+		return "X" + n.camel(ws)
+	}
+	return n.camel(ws)
+}
+
+func (n *namer) camel(ws []string) string {
+	var b strings.Builder
+	for _, w := range ws {
+		if n.acronyms[strings.ToLower(w)] {
+			b.WriteString(strings.ToUpper(w))
+			continue
+		}
+		b.WriteString(strings.ToUpper(w[:1]))
+		b.WriteString(strings.ToLower(w[1:]))
+	}
+	return b.String()
+}
+
+// strip removes the first configured prefix ws starts with, unless nothing
+// or only a number would be left.
+func (n *namer) strip(ws []string) []string {
+	for _, prefix := range n.opts.StripPrefixes {
+		p := words(prefix)
+		if len(p) == 0 || commonPrefix(ws, p) != len(p) || len(ws) == len(p) {
+			continue
+		}
+		if unicode.IsDigit(rune(ws[len(p)][0])) {
+			continue
+		}
+		return ws[len(p):]
+	}
+	return ws
+}
+
+// words splits a C identifier into words at underscores and case changes:
+// get_userID and GetUserId both give get, user, id.
+func words(name string) []string {
+	var ws []string
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			prev, cur := runes[i-1], runes[i]
+			lowerToUpper := (unicode.IsLower(prev) || unicode.IsDigit(prev)) && unicode.IsUpper(cur)
+			acronymEnd := unicode.IsUpper(prev) && unicode.IsUpper(cur) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if lowerToUpper || acronymEnd {
+				ws = append(ws, string(runes[start:i]))
+				start = i
+			}
+		}
+		ws = append(ws, string(runes[start:]))
+	}
+	return ws
+}
+
+func commonPrefix(a, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && strings.EqualFold(a[i], b[i]) {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,78 @@
+package generator
+
+import "testing"
+
+func TestDeclName(t *testing.T) {
+	tests := []struct {
+		name   string
+		naming NamingOptions
+		want   string
+	}{
+		{"get_user_id", NamingOptions{}, "GetUserID"},
+		{"GetUserId", NamingOptions{}, "GetUserID"},
+		{"parseHTTPResponse", NamingOptions{}, "ParseHTTPResponse"},
+		{"CalcConfig", NamingOptions{}, "CalcConfig"},
+		{"calc_add", NamingOptions{StripPrefixes: []string{"calc_"}}, "Add"},
+		{"calculate", NamingOptions{StripPrefixes: []string{"calc_"}}, "Calculate"},
+		{"calc_2d", NamingOptions{StripPrefixes: []string{"calc_"}}, "Calc2d"},
+		{"calc", NamingOptions{StripPrefixes: []string{"calc_"}}, "Calc"},
+		{"gl_vbo_bind", NamingOptions{Acronyms: []string{"gl", "vbo"}}, "GLVBOBind"},
+		{"get_user_id", NamingOptions{Acronyms: []string{}}, "GetUserId"},
+		{"calc_add", NamingOptions{Renames: map[string]string{"calc_add": "Plus"}, StripPrefixes: []string{"calc_"}}, "Plus"},
+		{"_3d_point", NamingOptions{}, "X3dPoint"},
+	}
+
+	for _, tt := range tests {
+		n := newNamer(Options{Naming: tt.naming})
+		if got := n.declName(tt.name); got != tt.want {
+			t.Errorf("declName(%q) with %+v = %s, want %s", tt.name, tt.naming, got, tt.want)
+		}
+	}
+}
+
+func TestEnumNaming(t *testing.T) {
+	const header = `
+typedef enum { CALC_COLOR_RED, CALC_COLOR_GREEN } calc_color;
+int calc_add(int a, int b);
+`
+	files := mustGenerate(t, header, Options{Naming: NamingOptions{
+		StripPrefixes:     []string{"calc_"},
+		TrimEnumPrefix:    true,
+		QualifyEnumValues: true,
+	}})
+	wantContains(t, files, "types.go", "type Color int32", "ColorRed Color = iota", "\tColorGreen\n")
+	wantContains(t, files, "functions.go", "func Add(a int32, b int32) int32")
+}
+
+func TestCollisions(t *testing.T) {
+	const header = `
+int get_id(void);
+int GetId(void);
+`
+	wantError(t, header, Options{}, "func get_id and func GetId both map to the Go name GetID; rename one of them")
+
+	files := mustGenerate(t, header, Options{Naming: NamingOptions{OnCollision: CollisionSuffix}})
+	wantContains(t, files, "functions.go", "func GetID() int32", "func GetID2() int32")
+
+	files = mustGenerate(t, header, Options{Naming: NamingOptions{Renames: map[string]string{"GetId": "FetchID"}}})
+	wantContains(t, files, "functions.go", "func GetID() int32", "func FetchID() int32")
+}
+
+func TestParamNames(t *testing.T) {
+	tests := []struct {
+		decl string
+		want string
+	}{
+		{"int set(int type, int range);", "func Set(type_ int32, range_ int32) int32"},
+		{"int set(int len, int string);", "func Set(len_ int32, string_ int32) int32"},
+		{"int set(int unsafe, int ffi);", "func Set(unsafe_ int32, ffi_ int32) int32"},
+		{"int set(int result, int err, int args);", "func Set(result2 int32, err2 int32, args2 int32) int32"},
+		{"int set(int, int);", "func Set(arg1 int32, arg2 int32) int32"},
+		{"int set(int setFunc);", "func Set(setFunc_ int32) int32"},
+	}
+
+	for _, tt := range tests {
+		files := mustGenerate(t, tt.decl, Options{})
+		wantContains(t, files, "functions.go", tt.want)
+	}
+}
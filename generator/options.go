@@ -0,0 +1,297 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// Backend selects the library the generated code uses to call into C.
+type Backend string
+
+const (
+	BackendFFI Backend = "ffi" // github.com/jupiterrider/ffi
+)
+
+// Layout selects how generated declarations are spread across files.
+type Layout string
+
+const (
+	LayoutSplit  Layout = "split"  // loader.go, types.go, functions.go, ...
+	LayoutSingle Layout = "single" // everything in <package>.go
+)
+
+// SliceParam names the pointer and length parameters of a C function, or the
+// fields of a struct, that take a Go slice.
+type SliceParam struct {
+	Function string
+	Pointer  string
+	Length   string
+}
+
+// StringList describes a char** array of strings.
+type StringList struct {
+	// Length names the parameter holding the number of strings: the
+	// length of a parameter, or an out-parameter receiving the length of
+	// a result. Without one, the array ends with a NULL pointer.
+	Length string
+
+	// FreeStrings frees each string of an owned result, with the function
+	// of OwnedResults, before the array itself.
+	FreeStrings bool
+}
+
+// Encoding is the encoding of a wide string.
+type Encoding string
+
+const (
+	EncodingUTF16 Encoding = "utf16"
+	EncodingUTF32 Encoding = "utf32"
+	EncodingWChar Encoding = "wchar" // wchar_t: UTF-16 on Windows, UTF-32 elsewhere
+)
+
+// GoType replaces the Go mapping of a named C type.
+type GoType struct {
+	Name   string // Go type, e.g. "Status" or "time.Duration"
+	FFI    string // libffi descriptor expression; empty keeps the C type's
+	Import string // import path Name needs, if any
+}
+
+type Options struct {
+	Package string   // Go package name; defaults to "bindings"
+	LibName string   // library name, "calc" loads libcalc.so; required
+	Targets []string // GOOS/GOARCH pairs to support; defaults to DefaultTargets
+
+	Naming NamingOptions
+
+	// Types overrides the Go type of C types by name. The Go type must have
+	// the same size and representation as the C type.
+	Types map[string]GoType
+
+	// TypeMappers are consulted before Types and the built-in mapping.
+	TypeMappers []TypeMapper
+
+	// HandleMethods turns functions whose first parameter is an opaque
+	// handle into methods of the handle, named without the handle's name:
+	// calc_add(Calc, ...) becomes Calc.Add. KeepFunctions also generates the
+	// flat functions, which forward to the methods.
+	HandleMethods bool
+	KeepFunctions bool
+
+	// HandlePairs and DetectHandlePairs wrap opaque handles that have a
+	// constructor and destructor in a Go type with an idempotent Close.
+	// Detection pairs functions ending in DefaultConstructorSuffixes with a
+	// single function ending in DefaultDestructorSuffixes. CleanupHandles
+	// also frees handles that are garbage collected without Close, logging a
+	// leak warning.
+	HandlePairs       []HandlePair
+	DetectHandlePairs bool
+	CleanupHandles    bool
+
+	// SliceParams and DetectSlices pass Go slices to pointer and length
+	// parameter pairs, like (const double* values, size_t count). The length
+	// leaves the Go signature and is set to len of the slice. Besides the
+	// configured pairs and those annotated with _In_reads_(count) and the
+	// like, detection pairs pointers to numbers, bools, enums and structs
+	// with a following integer parameter named like a length. Struct fields
+	// pair the same way, with Function naming the struct; their struct then
+	// has a C-layout mirror.
+	SliceParams  []SliceParam
+	DetectSlices bool
+
+	// StringParams keeps non-const char pointers, named "function.param",
+	// as Go strings. Other non-const char pointers are buffers C may write
+	// to: they take a []byte, and a following length parameter is set to
+	// its length. StringBuffers also generates, for functions with one
+	// such buffer and an integer result, a <Name>String wrapper returning
+	// the buffer's contents as a string. It retries with a larger buffer
+	// while the result reports truncation the way snprintf does.
+	StringParams  []string
+	StringBuffers bool
+
+	// OwnedResults names, by function, the C function freeing the string
+	// or pointer it returns; "free" is the C library's free. The wrappers
+	// of these functions copy the result into Go memory and free it.
+	// Other results are borrowed and never freed.
+	OwnedResults map[string]string
+
+	// StringLists makes char** results, keyed by function, and parameters,
+	// keyed "function.param", Go []strings. Parameters pass an array that
+	// lives for the duration of the call; results are copied. Pointers
+	// paired with a length through SliceParams or annotations are string
+	// lists too.
+	StringLists map[string]StringList
+
+	// WideStrings makes pointers to 16- and 32-bit integers Go strings of
+	// the given encoding. Keys are "function.param" for parameters,
+	// "function" for results, or the name of a typedef of the pointer or
+	// of its element, like LPCWSTR or WCHAR. Const wchar_t, char16_t and
+	// char32_t pointer parameters, and such results, are wide strings
+	// without configuration.
+	WideStrings map[string]Encoding
+
+	// Errors, if set, turns functions returning a status into wrappers
+	// returning an error.
+	Errors *ErrorConvention
+
+	// Errno lists path.Match patterns of functions reporting failures
+	// through errno. Their wrappers lock the OS thread, clear errno before
+	// the call and read it right after, and return it as a syscall.Errno
+	// error; status functions put it in the Errno field of their *Error.
+	Errno []string
+
+	// OutParams and InParams mark parameters, named "function.param", as
+	// out-parameters or not, overriding the _Out_/_In_ style annotations of
+	// the header. Out-parameters are allocated by the wrapper and returned
+	// before the C result. DetectOutParams also treats unannotated non-const
+	// pointers to numbers, bools and enums that are not followed by a length,
+	// and a trailing pointer to an opaque handle, as out-parameters.
+	OutParams       []string
+	InParams        []string
+	DetectOutParams bool
+
+	// Include and Exclude filter declarations by C name using path.Match
+	// patterns. An empty Include keeps everything.
+	Include []string
+	Exclude []string
+
+	Backend Backend // defaults to BackendFFI
+	Layout  Layout  // defaults to LayoutSplit
+
+	// Templates holds <name>.tmpl files replacing the built-in templates
+	// of the same name; see templates.go for the names and their data.
+	Templates fs.FS
+}
+
+func (o *Options) setDefaults() error {
+	if o.Package == "" {
+		o.Package = "bindings"
+	}
+	if o.LibName == "" {
+		return fmt.Errorf("library name is required")
+	}
+	if len(o.Targets) == 0 {
+		o.Targets = DefaultTargets
+	}
+
+	switch o.Backend {
+	case "":
+		o.Backend = BackendFFI
+	case BackendFFI:
+	default:
+		return fmt.Errorf("unsupported backend %q", o.Backend)
+	}
+
+	switch o.Naming.OnCollision {
+	case "":
+		o.Naming.OnCollision = CollisionError
+	case CollisionError, CollisionSuffix:
+	default:
+		return fmt.Errorf("unsupported collision policy %q", o.Naming.OnCollision)
+	}
+
+	switch o.Layout {
+	case "":
+		o.Layout = LayoutSplit
+	case LayoutSplit, LayoutSingle:
+	default:
+		return fmt.Errorf("unsupported layout %q", o.Layout)
+	}
+
+	for _, pattern := range slices.Concat(o.Include, o.Exclude, o.Errno) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func (o *Options) keep(name string) bool {
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(o.Include) > 0 && !matches(o.Include) {
+		return false
+	}
+	return !matches(o.Exclude)
+}
+
+// filter returns the declarations of module the options keep. It fails if a
+// kept declaration uses a struct or enum that was filtered out, since the
+// generated code would not compile.
+func (o *Options) filter(module *sema.Module) (*sema.Module, error) {
+	var out sema.Module
+	kept := make(map[string]bool)
+
+	for _, s := range module.Structs {
+		if o.keep(s.Name) {
+			out.Structs = append(out.Structs, s)
+			kept[s.Name] = true
+		}
+	}
+	for _, e := range module.Enums {
+		if o.keep(e.Name) {
+			out.Enums = append(out.Enums, e)
+			kept[e.Name] = true
+		}
+	}
+	for _, td := range module.Typedefs {
+		if o.keep(td.Name) {
+			out.Typedefs = append(out.Typedefs, td)
+		}
+	}
+	for _, fn := range module.Functions {
+		if o.keep(fn.Name) {
+			out.Functions = append(out.Functions, fn)
+		}
+	}
+
+	check := func(user string, t *sema.Type) error {
+		for t != nil {
+			if t.Kind == sema.KindStruct || t.Kind == sema.KindHandle || t.Kind == sema.KindEnum {
+				if !kept[t.Name] {
+					return fmt.Errorf("%s uses %s, which is excluded by the filters", user, t.Name)
+				}
+				return nil
+			}
+			t = t.Elem
+		}
+		return nil
+	}
+
+	var errs []error
+	for _, s := range out.Structs {
+		for _, f := range s.Fields {
+			errs = append(errs, check(s.Name, f.Type))
+		}
+	}
+	for _, fn := range out.Functions {
+		errs = append(errs, check(fn.Name, fn.Result))
+		for _, p := range fn.Params {
+			errs = append(errs, check(fn.Name, p.Type))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// isBuffer reports whether p, a parameter of fn, is a non-const char
+// pointer that is not kept as a string.
+func (o *Options) isBuffer(fn *sema.Function, p *sema.Param) bool {
+	return p.Type.IsString() && !p.Type.Underlying().Elem.Const && !slices.Contains(o.StringParams, fn.Name+"."+p.Name)
+}
@@ -0,0 +1,115 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// lengthWords are the last words of parameter names that make the preceding
+// pointer a buffer rather than an out-parameter, as in (int32_t* values,
+// size_t count).
+var lengthWords = []string{"len", "length", "size", "count", "n"}
+
+// findOutParams returns, by function, which parameters are out-parameters.
+// Functions without any are left out.
+// Slice pointers and lengths are never out-parameters.
+func findOutParams(module *sema.Module, opts Options, sliceParams map[*sema.Function]map[int]int) (map[*sema.Function][]bool, error) {
+	configured := make(map[string]bool)
+	for _, key := range opts.OutParams {
+		configured[key] = true
+	}
+	for _, key := range opts.InParams {
+		if configured[key] {
+			return nil, fmt.Errorf("parameter %s is both an in- and an out-parameter", key)
+		}
+		configured[key] = false
+	}
+
+	seen := make(map[string]bool)
+	outs := make(map[*sema.Function][]bool)
+	var errs []error
+
+	for _, fn := range module.Functions {
+		var flags []bool
+		for i, p := range fn.Params {
+			key := fn.Name + "." + p.Name
+			if isSliceParam(sliceParams[fn], i) {
+				seen[key] = true
+				continue
+			}
+
+			var out bool
+			if v, ok := configured[key]; ok && p.Name != "" {
+				seen[key] = true
+				out = v
+			} else if p.Direction != "" {
+				out = p.Direction == "out"
+			} else if opts.DetectOutParams {
+				out = looksLikeOutParam(fn, i)
+			}
+			if !out {
+				continue
+			}
+
+			if err := checkPointer(p.Type); err != nil {
+				errs = append(errs, fmt.Errorf("%s: out-parameter %s: %w", fn.Name, p.Name, err))
+				continue
+			}
+			if flags == nil {
+				flags = make([]bool, len(fn.Params))
+			}
+			flags[i] = true
+		}
+		if flags != nil {
+			outs[fn] = flags
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(configured)) {
+		if !seen[key] {
+			errs = append(errs, fmt.Errorf("parameter %s not found", key))
+		}
+	}
+
+	return outs, errors.Join(errs...)
+}
+
+// looksLikeOutParam reports whether the i-th parameter of fn is a non-const
+// pointer to a number, bool or enum that is not followed by a length, or the
+// last parameter and a pointer to an opaque handle.
+func looksLikeOutParam(fn *sema.Function, i int) bool {
+	t := fn.Params[i].Type.Underlying()
+	if t.Kind != sema.KindPointer || t.Elem.Const || t.IsString() {
+		return false
+	}
+
+	switch t.Elem.Underlying().Kind {
+	case sema.KindInt, sema.KindFloat, sema.KindBool, sema.KindEnum:
+		return i+1 == len(fn.Params) || !isLength(fn.Params[i+1])
+	case sema.KindHandle:
+		return i == len(fn.Params)-1
+	}
+	return false
+}
+
+// checkPointer reports why the wrapper cannot pass Go memory of the type t
+// points to.
+func checkPointer(t *sema.Type) error {
+	u := t.Underlying()
+	if u.Kind != sema.KindPointer {
+		return fmt.Errorf("%s is not a pointer", u.Kind)
+	}
+	if t.IsString() {
+		return fmt.Errorf("char pointers are strings")
+	}
+
+	switch e := u.Elem.Underlying(); e.Kind {
+	case sema.KindVoid, sema.KindIncomplete, sema.KindArray, sema.KindPointer:
+		return fmt.Errorf("pointer to %s is not supported", e.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// File is one generated Go source file.
+type File struct {
+	Name    string
+	Content []byte
+}
+
+// FileWriter receives generated files.
+type FileWriter interface {
+	WriteFile(name string, data []byte) error
+}
+
+// DirWriter writes files into a directory, creating it if needed.
+type DirWriter string
+
+func (d DirWriter) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(string(d), name), data, 0644)
+}
@@ -0,0 +1,102 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// libcFree is the OwnedResults value naming the C library's free.
+const libcFree = "free"
+
+// findOwnedResults returns, by function, the function freeing its result:
+// libcFree or another function of the module taking a single pointer.
+func findOwnedResults(module *sema.Module, owned map[string]string, lists map[string]StringList) (map[*sema.Function]string, error) {
+	funcs := make(map[string]*sema.Function)
+	for _, fn := range module.Functions {
+		funcs[fn.Name] = fn
+	}
+
+	found := make(map[*sema.Function]string)
+	var errs []error
+
+	for _, name := range slices.Sorted(maps.Keys(owned)) {
+		free := owned[name]
+		fn := funcs[name]
+		if fn == nil {
+			errs = append(errs, fmt.Errorf("owned result of %s: function not found", name))
+			continue
+		}
+		// String lists are checked by findStringLists.
+		if _, isList := lists[name]; !isList {
+			if err := checkOwnedResult(fn.Result); err != nil {
+				errs = append(errs, fmt.Errorf("owned result of %s: %w", name, err))
+				continue
+			}
+		}
+
+		if free != libcFree {
+			f := funcs[free]
+			if f == nil {
+				errs = append(errs, fmt.Errorf("owned result of %s: free function %s not found", name, free))
+				continue
+			}
+			if len(f.Params) != 1 || f.Variadic || f.Params[0].Type.Underlying().Kind != sema.KindPointer {
+				errs = append(errs, fmt.Errorf("owned result of %s: %s must take a single pointer", name, free))
+				continue
+			}
+		}
+		found[fn] = free
+	}
+
+	return found, errors.Join(errs...)
+}
+
+// isFree reports whether fn frees owned results. The wrappers of those
+// results call it, so it is not wrapped itself.
+func (g *Generator) isFree(fn *sema.Function) bool {
+	return slices.Contains(slices.Collect(maps.Values(g.owned)), fn.Name)
+}
+
+// checkOwnedResult reports why a result of type t cannot be copied into Go
+// memory.
+func checkOwnedResult(t *sema.Type) error {
+	if t.IsString() {
+		return nil
+	}
+	return checkPointer(t)
+}
+
+// ownedResultData fills in result, which receives an owned string, wide
+// string or pointer, and returns the Go type and value of the copy.
+func (g *Generator) ownedResultData(fn *sema.Function, result *ResultData) (ReturnData, error) {
+	free := g.names.funcVar(g.owned[fn])
+	if g.owned[fn] == libcFree {
+		free = g.names.libcFreeVar()
+	}
+	release := fmt.Sprintf("%s.Call(nil, unsafe.Pointer(&resultPtr))", free)
+
+	result.Arg = "unsafe.Pointer(&resultPtr)"
+	if fn.Result.IsString() {
+		result.Decl = "var resultPtr *byte"
+		result.After = fmt.Sprintf("result := bytePtrToString(resultPtr)\nif resultPtr != nil {\n\t%s\n}", release)
+		return ReturnData{GoType: "string", Value: "result", Zero: `""`}, nil
+	}
+	if enc, ok := g.wide.results[fn]; ok {
+		h := wideHelpers[enc]
+		result.Decl = "var resultPtr " + h.ptrType
+		result.After = fmt.Sprintf("result := %s(resultPtr)\nif resultPtr != nil {\n\t%s\n}", h.toString, release)
+		return ReturnData{GoType: "string", Value: "result", Zero: `""`}, nil
+	}
+
+	m := g.mapType(fn.Result.Underlying().Elem)
+	if m.converts() {
+		return ReturnData{}, fmt.Errorf("owned result: %s needs a conversion", m.GoType)
+	}
+	result.Decl = fmt.Sprintf("var resultPtr *%s", m.GoType)
+	result.After = fmt.Sprintf("var result *%s\nif resultPtr != nil {\n\tresult = new(%s)\n\t*result = *resultPtr\n\t%s\n}", m.GoType, m.GoType, release)
+	return ReturnData{GoType: "*" + m.GoType, Value: "result", Zero: "nil"}, nil
+}
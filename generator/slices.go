@@ -0,0 +1,208 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// findSliceParams returns, by function, the slice parameters: the index of
+// each pointer mapped to the index of its length. Slices may share a length.
+// Char pointers are byte slices, and char** string lists.
+func findSliceParams(module *sema.Module, opts Options) (map[*sema.Function]map[int]int, error) {
+	funcs := make(map[string]*sema.Function)
+	for _, fn := range module.Functions {
+		funcs[fn.Name] = fn
+	}
+
+	found := make(map[*sema.Function]map[int]int)
+	var errs []error
+
+	add := func(fn *sema.Function, ptr, length int) {
+		p, l := fn.Params[ptr], fn.Params[length]
+		if err := checkSliceParam(p.Type, l.Type); err != nil {
+			errs = append(errs, fmt.Errorf("%s: slice %s: %w", fn.Name, p.Name, err))
+			return
+		}
+		pairs := found[fn]
+		if pairs == nil {
+			pairs = make(map[int]int)
+			found[fn] = pairs
+		}
+		pairs[ptr] = length
+	}
+
+	for _, sp := range opts.SliceParams {
+		fn := funcs[sp.Function]
+		if fn == nil && slices.ContainsFunc(module.Structs, func(s *sema.Struct) bool { return s.Name == sp.Function }) {
+			continue // a struct field, see findMirrors
+		}
+		if fn == nil {
+			errs = append(errs, fmt.Errorf("slice %s.%s: function not found", sp.Function, sp.Pointer))
+			continue
+		}
+		ptr, length := paramIndex(fn, sp.Pointer), paramIndex(fn, sp.Length)
+		if ptr < 0 || length < 0 || ptr == length {
+			errs = append(errs, fmt.Errorf("slice %s.%s: %s has no parameters %s and %s", sp.Function, sp.Pointer, sp.Function, sp.Pointer, sp.Length))
+			continue
+		}
+		add(fn, ptr, length)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(opts.StringLists)) {
+		name, param, ok := strings.Cut(key, ".")
+		fn := funcs[name]
+		if !ok || fn == nil || opts.StringLists[key].Length == "" || paramIndex(fn, param) < 0 {
+			continue // see findStringLists
+		}
+		ptr, length := paramIndex(fn, param), paramIndex(fn, opts.StringLists[key].Length)
+		if length < 0 || length == ptr {
+			errs = append(errs, fmt.Errorf("string list %s: %s has no parameter %s", key, name, opts.StringLists[key].Length))
+			continue
+		}
+		add(fn, ptr, length)
+	}
+
+	for _, fn := range module.Functions {
+		for i, p := range fn.Params {
+			if _, ok := found[fn][i]; ok {
+				continue
+			}
+			if p.Length != "" {
+				length := paramIndex(fn, p.Length)
+				if length < 0 || length == i {
+					errs = append(errs, fmt.Errorf("%s: slice %s: no length parameter %s", fn.Name, p.Name, p.Length))
+					continue
+				}
+				add(fn, i, length)
+				continue
+			}
+			// Buffers always take the length that follows them.
+			if !opts.isBuffer(fn, p) && !(opts.DetectSlices && looksLikeSlice(fn, i)) {
+				continue
+			}
+			if i+1 < len(fn.Params) && isLength(fn.Params[i+1]) && !isSliceParam(found[fn], i+1) {
+				add(fn, i, i+1)
+			}
+		}
+	}
+
+	for _, key := range opts.StringParams {
+		name, param, _ := strings.Cut(key, ".")
+		fn := funcs[name]
+		if fn == nil || paramIndex(fn, param) < 0 {
+			errs = append(errs, fmt.Errorf("string parameter %s not found", key))
+		} else if !fn.Params[paramIndex(fn, param)].Type.IsString() {
+			errs = append(errs, fmt.Errorf("string parameter %s is not a char pointer", key))
+		}
+	}
+
+	return found, errors.Join(errs...)
+}
+
+// looksLikeSlice reports whether the i-th parameter of fn is a pointer to a
+// number, bool, enum or struct.
+func looksLikeSlice(fn *sema.Function, i int) bool {
+	t := fn.Params[i].Type.Underlying()
+	if t.Kind != sema.KindPointer || t.IsString() {
+		return false
+	}
+
+	switch t.Elem.Underlying().Kind {
+	case sema.KindInt, sema.KindFloat, sema.KindBool, sema.KindEnum, sema.KindStruct:
+		return true
+	}
+	return false
+}
+
+// isLength reports whether p is an integer named like a length: count,
+// buf_size or num_items.
+func isLength(p *sema.Param) bool {
+	ws := words(p.Name)
+	if p.Type.Underlying().Kind != sema.KindInt || len(ws) == 0 {
+		return false
+	}
+	first, last := strings.ToLower(ws[0]), strings.ToLower(ws[len(ws)-1])
+	return slices.Contains(lengthWords, last) || len(ws) > 1 && (first == "num" || first == "n")
+}
+
+// checkSliceParam reports why ptr and length cannot take a Go slice.
+func checkSliceParam(ptr, length *sema.Type) error {
+	if !ptr.IsString() && !isStringArray(ptr) {
+		if err := checkPointer(ptr); err != nil {
+			return err
+		}
+	}
+	if k := length.Underlying().Kind; k != sema.KindInt {
+		return fmt.Errorf("length is %s, not an integer", k)
+	}
+	return nil
+}
+
+// isSliceParam reports whether the i-th parameter is a slice pointer or
+// length in pairs.
+func isSliceParam(pairs map[int]int, i int) bool {
+	_, ok := pairs[i]
+	return ok || slices.Contains(slices.Collect(maps.Values(pairs)), i)
+}
+
+func paramIndex(fn *sema.Function, name string) int {
+	return slices.IndexFunc(fn.Params, func(p *sema.Param) bool { return p.Name == name })
+}
+
+// defaultBufferSize is the first buffer size tried by string wrappers.
+const defaultBufferSize = 256
+
+// findStringBuffers returns, by function, the index of the buffer that gets
+// a string wrapper: the only buffer of a function that has a length and an
+// integer result that is not a status, and no out-parameters.
+func findStringBuffers(module *sema.Module, opts Options, sliceParams map[*sema.Function]map[int]int, outs map[*sema.Function][]bool, conv *errorConvention) map[*sema.Function]int {
+	found := make(map[*sema.Function]int)
+	for _, fn := range module.Functions {
+		if fn.Variadic || outs[fn] != nil || conv != nil && conv.funcs[fn] {
+			continue
+		}
+		if k := fn.Result.Underlying().Kind; k != sema.KindInt && k != sema.KindEnum {
+			continue
+		}
+
+		buf := -1
+		for i, p := range fn.Params {
+			if !p.Type.IsString() || !opts.isBuffer(fn, p) {
+				continue
+			}
+			if _, ok := sliceParams[fn][i]; !ok || buf >= 0 {
+				buf = -1
+				break
+			}
+			buf = i
+		}
+		if buf >= 0 {
+			found[fn] = buf
+		}
+	}
+	return found
+}
+
+func (g *Generator) stringBufferData(fn *sema.Function, fd FunctionData, buf int) StringBufferData {
+	data := StringBufferData{
+		GoName:   g.names.stringFunc(fd.Name),
+		Function: fd.GoName,
+		Receiver: fd.Receiver,
+		Buffer:   fd.Params[buf].GoName,
+		Result:   fd.Returns[0].GoType,
+		Signed:   fn.Result.Underlying().Signed,
+		Size:     defaultBufferSize,
+	}
+	for _, p := range fd.GoParams {
+		data.Args = append(data.Args, p.GoName)
+		if p.GoName != data.Buffer {
+			data.Params = append(data.Params, p)
+		}
+	}
+	return data
+}
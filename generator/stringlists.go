@@ -0,0 +1,134 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// stringLists are the char** parameters and results taking or returning a
+// Go []string. Parameters with a length are slice parameters.
+type stringLists struct {
+	params  map[*sema.Function]map[int]bool // NULL-terminated parameters
+	results map[*sema.Function]*listResult
+	used    bool // the conversion helpers are generated
+}
+
+type listResult struct {
+	length      int // index of the out-parameter receiving the length; -1 if NULL-terminated
+	freeStrings bool
+}
+
+// findStringLists resolves opts.StringLists. Results freeing their strings
+// must be owned.
+func findStringLists(module *sema.Module, opts Options, sliceParams map[*sema.Function]map[int]int, owned map[*sema.Function]string) (*stringLists, error) {
+	funcs := make(map[string]*sema.Function)
+	for _, fn := range module.Functions {
+		funcs[fn.Name] = fn
+	}
+
+	lists := &stringLists{
+		params:  make(map[*sema.Function]map[int]bool),
+		results: make(map[*sema.Function]*listResult),
+	}
+	var errs []error
+
+	for _, key := range slices.Sorted(maps.Keys(opts.StringLists)) {
+		sl := opts.StringLists[key]
+		name, param, isParam := strings.Cut(key, ".")
+		fn := funcs[name]
+		if fn == nil {
+			errs = append(errs, fmt.Errorf("string list %s: function not found", key))
+			continue
+		}
+
+		if isParam {
+			i := paramIndex(fn, param)
+			switch {
+			case i < 0:
+				errs = append(errs, fmt.Errorf("string list %s: %s has no parameter %s", key, name, param))
+			case !isStringArray(fn.Params[i].Type):
+				errs = append(errs, fmt.Errorf("string list %s: %s is not a char**", key, param))
+			case sl.FreeStrings:
+				errs = append(errs, fmt.Errorf("string list %s: parameters are never freed", key))
+			case sl.Length == "":
+				if lists.params[fn] == nil {
+					lists.params[fn] = make(map[int]bool)
+				}
+				lists.params[fn][i] = true
+			}
+			continue
+		}
+
+		result := &listResult{length: -1, freeStrings: sl.FreeStrings}
+		if !isStringArray(fn.Result) {
+			errs = append(errs, fmt.Errorf("string list %s: result is not a char**", key))
+			continue
+		}
+		if _, ok := owned[fn]; sl.FreeStrings && !ok {
+			errs = append(errs, fmt.Errorf("string list %s: freeing the strings needs an owned result", key))
+			continue
+		}
+		if sl.Length != "" {
+			result.length = paramIndex(fn, sl.Length)
+			if result.length < 0 {
+				errs = append(errs, fmt.Errorf("string list %s: %s has no parameter %s", key, name, sl.Length))
+				continue
+			}
+			if t := fn.Params[result.length].Type.Underlying(); t.Kind != sema.KindPointer || t.Elem.Underlying().Kind != sema.KindInt {
+				errs = append(errs, fmt.Errorf("string list %s: length %s is not a pointer to an integer", key, sl.Length))
+				continue
+			}
+		}
+		lists.results[fn] = result
+	}
+
+	lists.used = len(lists.params) > 0 || len(lists.results) > 0
+	for fn, pairs := range sliceParams {
+		for ptr := range pairs {
+			lists.used = lists.used || isStringArray(fn.Params[ptr].Type)
+		}
+	}
+
+	return lists, errors.Join(errs...)
+}
+
+// isStringArray reports whether t is a char**.
+func isStringArray(t *sema.Type) bool {
+	u := t.Underlying()
+	return u.Kind == sema.KindPointer && u.Elem.IsString()
+}
+
+// isListLength reports whether the i-th parameter of fn receives the length
+// of its string list result.
+func (l *stringLists) isListLength(fn *sema.Function, i int) bool {
+	r := l.results[fn]
+	return r != nil && r.length == i
+}
+
+// stringListResultData fills in result, which receives a string list, and
+// returns its Go result. n is the expression of the number of strings.
+func (g *Generator) stringListResultData(fn *sema.Function, n string, result *ResultData) ReturnData {
+	result.Decl = "var resultPtr **byte"
+	result.Arg = "unsafe.Pointer(&resultPtr)"
+	result.After = fmt.Sprintf("result := stringArrayFromC(resultPtr, %s)", n)
+
+	if free, ok := g.owned[fn]; ok {
+		freeVar := g.names.funcVar(free)
+		if free == libcFree {
+			freeVar = g.names.libcFreeVar()
+		}
+		var release string
+		if g.lists.results[fn].freeStrings {
+			release = fmt.Sprintf("for _, p := range unsafe.Slice(resultPtr, len(result)) {\n\t%s.Call(nil, unsafe.Pointer(&p))\n}\n", freeVar)
+		}
+		release += fmt.Sprintf("%s.Call(nil, unsafe.Pointer(&resultPtr))", freeVar)
+		result.After += fmt.Sprintf("\nif resultPtr != nil {\n\t%s\n}", release)
+	}
+
+	return ReturnData{GoType: "[]string", Value: "result", Zero: "nil"}
+}
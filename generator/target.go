@@ -0,0 +1,100 @@
+package generator
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// DefaultTargets are the GOOS/GOARCH pairs supported by jupiterrider/ffi.
+var DefaultTargets = []string{
+	"darwin/amd64",
+	"darwin/arm64",
+	"freebsd/amd64",
+	"freebsd/arm64",
+	"linux/amd64",
+	"linux/arm64",
+	"windows/amd64",
+	"windows/arm64",
+}
+
+// noComplexTargets are targets whose libffi builds are compiled without
+// FFI_TARGET_HAS_COMPLEX_TYPE, so complex arguments and returns cannot be
+// described there.
+var noComplexTargets = map[string]bool{
+	"windows/amd64": true,
+	"windows/arm64": true,
+}
+
+// wchar16Targets are targets whose wchar_t has 16 bits rather than the 32
+// bits sema gives it.
+var wchar16Targets = map[string]bool{
+	"windows/amd64": true,
+	"windows/arm64": true,
+}
+
+func (g *Generator) checkTargets() error {
+	for _, t := range g.opts.Targets {
+		if !slices.Contains(DefaultTargets, t) {
+			return fmt.Errorf("unsupported target %s, supported targets are %s", t, strings.Join(DefaultTargets, ", "))
+		}
+	}
+
+	var noComplex, wchar16 []string
+	for _, t := range g.opts.Targets {
+		if noComplexTargets[t] {
+			noComplex = append(noComplex, t)
+		}
+		if wchar16Targets[t] {
+			wchar16 = append(wchar16, t)
+		}
+	}
+	if len(noComplex) == 0 && len(wchar16) == 0 {
+		return nil
+	}
+
+	// check reports t if it is not supported on every target. Pointers to
+	// wchar_t are reported unless addressOnly: they convert to Go strings or
+	// are struct fields, which keep the address.
+	check := func(where string, t *sema.Type, addressOnly bool) error {
+		if u := t.Underlying(); u.Kind == sema.KindArray {
+			t = u.Elem
+		}
+		u := t.Underlying()
+		if u.Kind == sema.KindComplex && len(noComplex) > 0 {
+			return fmt.Errorf("%s: %s _Complex is not supported by libffi on %s; restrict the targets with -targets", where, u.Name, strings.Join(noComplex, ", "))
+		}
+		if u.Kind == sema.KindPointer && !addressOnly {
+			u = u.Elem.Underlying()
+		}
+		if u.Name == "wchar_t" && len(wchar16) > 0 {
+			return fmt.Errorf("%s: wchar_t has 16 bits on %s, so only wide string pointers to it are supported; restrict the targets with -targets", where, strings.Join(wchar16, ", "))
+		}
+		return nil
+	}
+
+	for _, s := range g.module.Structs {
+		for _, f := range s.Fields {
+			if err := check(s.Name+"."+f.Name, f.Type, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, fn := range g.module.Functions {
+		_, wide := g.wide.results[fn]
+		if err := check(fn.Name, fn.Result, wide); err != nil {
+			return err
+		}
+		for i, p := range fn.Params {
+			_, wide := g.wide.params[fn][i]
+			if err := check(fn.Name, p.Type, wide); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
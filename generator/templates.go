@@ -0,0 +1,238 @@
+package generator
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"strings"
+	"text/template"
+)
+
+// Every generated declaration is produced by one of the templates in
+// templates/, executed with the data type listed next to it:
+//
+//	header.tmpl          FileData           comment placed above the package clause
+//	loader.tmpl          LoaderData         Load and the library path lookup
+//	layout.tmpl          LayoutData         verifyLayouts, which checks structs against libffi
+//	handle.tmpl          StructData         opaque struct handle
+//	managed_handle.tmpl  ManagedHandleData  opaque handle with Close
+//	struct.tmpl          StructData         struct and its libffi type
+//	mirror.tmpl          StructData         C-layout mirror of a struct and its conversions
+//	packed_struct.tmpl   StructData         byte-array-backed struct with accessors
+//	flexible.tmpl        StructData         flexible array member accessor
+//	enum.tmpl            EnumData           enum type and constants
+//	error.tmpl           ErrorData          error type of status functions
+//	function_vars.tmpl   FunctionsData      ffi.Fun variables
+//	load_funcs.tmpl      FunctionsData      loadFuncs, which prepares every function
+//	libc.tmpl            nil                loadLibc, which finds the C runtime for free and errno
+//	function.tmpl        FunctionData       wrapper of one C function
+//	string_buffer.tmpl   StringBufferData   wrapper returning a char buffer as a string
+//	errno.tmpl           nil                errno access for functions reporting errors through it
+//	cstring.tmpl         nil                conversions of C strings that build on every GOOS
+//	string_array.tmpl    nil                conversions of string lists to and from C arrays
+//	wide_string.tmpl     WideStringData     conversions of UTF-16, UTF-32 and wchar_t strings
+//	variadic.tmpl        FunctionsData      runtime support for variadic functions
+//
+// Options.Templates replaces individual templates with files of the same
+// name. The output of every template must be valid Go declarations.
+//
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+type FileData struct {
+	Package string
+	Name    string // file name, e.g. "types.go"
+}
+
+type LoaderData struct {
+	Package string
+	LibName string // "calc" for libcalc.so
+
+	VerifyLayouts bool // Load calls verifyLayouts
+}
+
+type LayoutData struct {
+	Structs []StructData // natural structs with fields
+}
+
+type StructData struct {
+	Name      string // C name
+	GoName    string
+	FFIVar    string // the libffi type of natural structs
+	Size      int
+	Align     int
+	AlignType string // zero-length field forcing the alignment of packed structs, if any
+	Fields    []FieldData
+	Elements  int           // libffi elements of natural structs, arrays counting once per element
+	Flexible  *FlexibleData // trailing flexible array member, if any
+	Mirror    *MirrorData   // C layout of a struct whose Go layout differs, if any
+}
+
+type MirrorData struct {
+	GoName   string
+	ToC      string      // func(s Struct, pinner *runtime.Pinner) mirror
+	FromC    string      // func(c mirror) Struct
+	ToCPtr   string      // pointer form of ToC, if used
+	FromCPtr string      // pointer form of FromC, if used
+	Fields   []FieldData // every field, with its C type
+}
+
+type FieldData struct {
+	Name     string // C name
+	GoName   string
+	GoType   string
+	Setter   string   // setter method of packed struct fields
+	FFITypes []string // libffi descriptors, one per element for arrays
+	Index    int      // libffi element of the field, or of its first element
+	ToC      string   // statements copying the field of s into the mirror c
+	FromC    string   // statements copying the field of the mirror c into s
+	Offset   int      // byte offset in the C struct
+	Size     int
+	End      int // Offset + Size
+}
+
+type FlexibleData struct {
+	GoName   string
+	ElemType string
+	Offset   int
+	Count    string // Go expression reading the count field; empty if unknown
+}
+
+type ManagedHandleData struct {
+	GoName        string
+	WrapFunc      string // wraps a C handle: func(h uintptr, owned bool) *GoName
+	FreeFunc      string // calls the destructor: func(h uintptr) error
+	Destructor    string // C name of the destructor
+	DestructorVar string // its ffi.Fun variable
+	Status        string // Go type of the destructor's integer result; empty if void
+	Cleanup       bool   // register a runtime.AddCleanup leak guard
+	FlatFree      string // destructor function forwarding to Close; may be empty
+	FlatFreeParam string
+}
+
+type EnumData struct {
+	Name   string // C name
+	GoName string
+	Values []EnumValueData
+}
+
+type EnumValueData struct {
+	Name   string // C name
+	GoName string
+	Value  string // C initializer; empty continues the sequence
+}
+
+type FunctionsData struct {
+	Functions []FunctionData
+	LibcFree  string // ffi.Fun variable of the C library's free, if used
+	Errno     bool   // some functions report errors through errno
+}
+
+type FunctionData struct {
+	Name      string // C name, also the symbol looked up in the library
+	GoName    string // the function, or the method if Receiver is set
+	VarName   string // the ffi.Fun variable
+	Variadic  bool
+	Pinner    bool         // declares pinner, which pins the Go memory of mirrors until the call returns
+	Errno     bool         // errno is cleared before the call and read into errno after it
+	KeepAlive []string     // managed handles kept reachable until the call returns, so their cleanup cannot free them during it
+	Params    []ParamData  // all parameters, in C order
+	GoParams  []ParamData  // parameters of the Go signature, without the receiver
+	Receiver  *ParamData   // the handle parameter of methods, nil for functions
+	FlatName  string       // function kept next to a method, forwarding to it; may be empty
+	Result    *ResultData  // receives the C result; nil for void functions
+	Returns   []ReturnData // Go results: the out-parameters, then the C result
+	FFIResult string
+	FFIParams []string
+}
+
+type WideStringData struct {
+	UTF16 bool // utf16PtrFromString and utf16PtrToString
+	UTF32 bool // utf32PtrFromString and utf32PtrToString
+	WChar bool // wcharPtrFromString and wcharPtrToString, which use both
+}
+
+type StringBufferData struct {
+	GoName   string      // the wrapper, e.g. CalcFormatString
+	Function string      // the wrapped function, or method if Receiver is set
+	Receiver *ParamData  // the handle parameter of methods, nil for functions
+	Params   []ParamData // parameters of the Go signature, without the buffer
+	Buffer   string      // the []byte variable passed as the buffer
+	Args     []string    // arguments of the wrapped function
+	Result   string      // Go type of the integer result
+	Signed   bool        // the result is signed and negative on error
+	Size     int         // first buffer size tried
+}
+
+type ParamData struct {
+	Name   string // C name, may be empty
+	GoName string
+	GoType string
+	Setup  string // statements converting the parameter before the call
+	Arg    string // expression passed to Call
+	Out    bool   // out-parameter, left out of the Go signature
+	Length bool   // length of a slice parameter, left out of the Go signature
+	After  string // statements run after the call, such as copying back what C wrote
+}
+
+type ResultData struct {
+	Decl  string // declares the variable the result is received in
+	Arg   string // expression passed to Call
+	After string // statements run after the call, such as freeing an owned result
+}
+
+type ReturnData struct {
+	GoType string
+	Value  string // expression converting the C value after the call
+	Zero   string // zero value, returned with errors
+}
+
+type ErrorData struct {
+	GoName      string // the error type, *GoName is returned
+	CodeType    string // Go type of statuses, which implements error
+	DeclareCode bool   // CodeType is declared here rather than by an enum
+	Errno       bool   // add the Errno field
+	Status      string // C name of the status type, for messages
+	Describe    string // expression describing the status c; empty for the default
+}
+
+// loadTemplates parses the built-in templates and the overrides in dir, if
+// any. Overrides must use the name of a built-in template.
+func loadTemplates(dir fs.FS) (*template.Template, error) {
+	t, err := template.New("").Funcs(templateFuncs).ParseFS(defaultTemplates, "templates/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == nil {
+		return t, nil
+	}
+
+	names, err := fs.Glob(dir, "*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return t, nil
+	}
+	for _, name := range names {
+		if t.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown template %s", name)
+		}
+	}
+
+	return t.ParseFS(dir, names...)
+}
+
+func (g *Generator) execute(name string, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := g.templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,211 @@
+package generator
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// TypeMapper maps C types to Go types. Mappers in Options.TypeMappers are
+// asked in order, first for a type and then for each typedef it is declared
+// through; the built-in mapping applies when none of them knows the type.
+type TypeMapper interface {
+	MapType(t *sema.Type) (Mapping, bool)
+}
+
+// Mapping describes how values of a C type appear in the generated Go API.
+type Mapping struct {
+	GoType  string   // Go type of parameters, results and struct fields
+	FFIType string   // libffi descriptor; empty keeps the built-in one
+	Imports []string // import paths of the packages GoType and the snippets use
+
+	// CType, ToC and FromC convert Go values whose representation differs
+	// from the C type. CType is a Go type with the layout of the C type, and
+	// ToC and FromC are expressions in which %s stands for the value being
+	// converted, e.g. "vec3FromGo(%s)". Struct fields use CType.
+	CType string
+	ToC   string
+	FromC string
+}
+
+func (m Mapping) converts() bool {
+	return m.ToC != "" || m.FromC != ""
+}
+
+// mapType returns the mapping of t, recording the imports it needs.
+func (g *Generator) mapType(t *sema.Type) Mapping {
+	m, ok := g.customMapping(t)
+	if !ok {
+		return g.defaultMapper.mapping(t)
+	}
+
+	if m.FFIType == "" {
+		m.FFIType = g.defaultMapper.ffiType(t)
+	}
+	if m.converts() {
+		if m.CType == "" {
+			m.CType = g.defaultMapper.goType(t)
+		}
+		if m.ToC == "" {
+			m.ToC = m.CType + "(%s)"
+		}
+		if m.FromC == "" {
+			m.FromC = m.GoType + "(%s)"
+		}
+	}
+	for _, imp := range m.Imports {
+		g.imports[path.Base(imp)] = imp
+	}
+
+	return m
+}
+
+func (g *Generator) customMapping(t *sema.Type) (Mapping, bool) {
+	for ; t != nil; t = t.Elem {
+		for _, mapper := range g.mappers {
+			if m, ok := mapper.MapType(t); ok {
+				return m, true
+			}
+		}
+		if t.Kind != sema.KindTypedef {
+			break
+		}
+	}
+	return Mapping{}, false
+}
+
+// goType returns the Go type used for t in the wrapper API.
+func (g *Generator) goType(t *sema.Type) string {
+	return g.mapType(t).GoType
+}
+
+// fieldType returns the Go type of t in memory shared with C.
+func (g *Generator) fieldType(t *sema.Type) string {
+	// Mirrors are converted by value, so pointers to them stay raw.
+	if g.mirrorPtrOf(t) != nil {
+		return "uintptr"
+	}
+	if m := g.mapType(t); m.converts() {
+		return m.CType
+	}
+	return g.goType(t)
+}
+
+// rawGoType is fieldType for memory the generated code reads directly, where
+// a C string is a plain pointer rather than a Go string.
+func (g *Generator) rawGoType(t *sema.Type) string {
+	if t.IsString() {
+		return "uintptr"
+	}
+	// Mirrors only exist for the duration of a call, so the raw memory of
+	// structs with one is exposed as bytes.
+	if needsMirror(t, g.mirrors) {
+		return fmt.Sprintf("[%d]byte", t.Size)
+	}
+	return g.fieldType(t)
+}
+
+func (g *Generator) ffiType(t *sema.Type) string {
+	return g.mapType(t).FFIType
+}
+
+// typeTable is the TypeMapper behind Options.Types.
+type typeTable map[string]GoType
+
+func (tt typeTable) MapType(t *sema.Type) (Mapping, bool) {
+	o, ok := tt[t.Name]
+	if !ok || t.Name == "" {
+		return Mapping{}, false
+	}
+
+	m := Mapping{GoType: o.Name, FFIType: o.FFI}
+	if o.Import != "" {
+		m.Imports = []string{o.Import}
+	}
+	return m, true
+}
+
+// defaultMapper is the built-in mapping of C types to Go types with the same
+// memory layout.
+type defaultMapper struct {
+	names *namer
+}
+
+func (d defaultMapper) MapType(t *sema.Type) (Mapping, bool) {
+	return d.mapping(t), true
+}
+
+func (d defaultMapper) mapping(t *sema.Type) Mapping {
+	return Mapping{GoType: d.goType(t), FFIType: d.ffiType(t)}
+}
+
+func (d defaultMapper) goType(t *sema.Type) string {
+	u := t.Underlying()
+
+	switch u.Kind {
+	case sema.KindVoid:
+		return ""
+	case sema.KindBool:
+		return "bool"
+	case sema.KindInt:
+		if u.Signed {
+			return fmt.Sprintf("int%d", u.Size*8)
+		}
+		return fmt.Sprintf("uint%d", u.Size*8)
+	case sema.KindFloat:
+		return fmt.Sprintf("float%d", u.Size*8)
+	case sema.KindComplex:
+		return fmt.Sprintf("complex%d", u.Size*8)
+	case sema.KindPointer:
+		if t.IsString() {
+			return "string"
+		}
+		if e := u.Elem.Underlying(); e.Kind == sema.KindStruct {
+			return "*" + d.names.typeName(e.Name)
+		}
+		return "uintptr"
+	case sema.KindArray:
+		if u.Elem.IsString() {
+			return fmt.Sprintf("[%d]uintptr", u.Len)
+		}
+		return fmt.Sprintf("[%d]%s", u.Len, d.goType(u.Elem))
+	case sema.KindStruct, sema.KindHandle, sema.KindEnum:
+		return d.names.typeName(u.Name)
+	default:
+		return "uintptr"
+	}
+}
+
+func (d defaultMapper) ffiType(t *sema.Type) string {
+	u := t.Underlying()
+
+	switch u.Kind {
+	case sema.KindVoid:
+		return "&ffi.TypeVoid"
+	case sema.KindBool:
+		return "&ffi.TypeUint8"
+	case sema.KindInt, sema.KindEnum:
+		if u.Signed {
+			return fmt.Sprintf("&ffi.TypeSint%d", u.Size*8)
+		}
+		return fmt.Sprintf("&ffi.TypeUint%d", u.Size*8)
+	case sema.KindFloat:
+		if u.Size == 4 {
+			return "&ffi.TypeFloat"
+		}
+		return "&ffi.TypeDouble"
+	case sema.KindComplex:
+		if u.Size == 8 {
+			return "&ffi.TypeComplexFloat"
+		}
+		return "&ffi.TypeComplexDouble"
+	case sema.KindStruct:
+		if u.Struct.Natural {
+			return "&" + d.names.ffiTypeVar(u.Name)
+		}
+		return "&ffi.TypePointer"
+	default:
+		return "&ffi.TypePointer"
+	}
+}
@@ -0,0 +1,30 @@
+package generator
+
+import (
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+func (g *Generator) generateVariadic(f *goFile) error {
+	var data FunctionsData
+	for _, fn := range g.module.Functions {
+		if !fn.Variadic {
+			continue
+		}
+		fd, err := g.functionData(fn)
+		if err != nil {
+			return err
+		}
+		data.Functions = append(data.Functions, fd)
+	}
+
+	return g.addTemplate(f, "variadic support", "variadic.tmpl", data)
+}
+
+func hasVariadic(fns []*sema.Function) bool {
+	for _, fn := range fns {
+		if fn.Variadic {
+			return true
+		}
+	}
+	return false
+}
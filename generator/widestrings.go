@@ -0,0 +1,200 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/ffi-converter/sema"
+)
+
+// wideStrings are the pointer parameters and results taking or returning a
+// Go string in a 16- or 32-bit encoding.
+type wideStrings struct {
+	params  map[*sema.Function]map[int]Encoding
+	results map[*sema.Function]Encoding
+	used    map[Encoding]bool // encodings whose conversion helpers are generated
+}
+
+// wideHelper describes the generated conversions of an encoding.
+type wideHelper struct {
+	ptrType    string // Go type of the C pointer
+	fromString string
+	toString   string
+}
+
+var wideHelpers = map[Encoding]wideHelper{
+	EncodingUTF16: {"*uint16", "utf16PtrFromString", "utf16PtrToString"},
+	EncodingUTF32: {"*uint32", "utf32PtrFromString", "utf32PtrToString"},
+	EncodingWChar: {"unsafe.Pointer", "wcharPtrFromString", "wcharPtrToString"},
+}
+
+// findWideStrings resolves opts.WideStrings and detects const wchar_t,
+// char16_t and char32_t pointer parameters and such results. Slices,
+// out-parameters and string lists keep their own conversions.
+func findWideStrings(module *sema.Module, opts Options, sliceParams map[*sema.Function]map[int]int, outs map[*sema.Function][]bool, lists *stringLists) (*wideStrings, error) {
+	funcs := make(map[string]*sema.Function)
+	for _, fn := range module.Functions {
+		funcs[fn.Name] = fn
+	}
+	typedefs := make(map[string]*sema.Type)
+	for _, td := range module.Typedefs {
+		typedefs[td.Name] = td
+	}
+
+	wide := &wideStrings{
+		params:  make(map[*sema.Function]map[int]Encoding),
+		results: make(map[*sema.Function]Encoding),
+		used:    make(map[Encoding]bool),
+	}
+	byTypedef := make(map[string]Encoding)
+	var errs []error
+
+	for _, key := range slices.Sorted(maps.Keys(opts.WideStrings)) {
+		enc := opts.WideStrings[key]
+		if _, ok := wideHelpers[enc]; !ok {
+			errs = append(errs, fmt.Errorf("wide string %s: unsupported encoding %q", key, enc))
+			continue
+		}
+
+		name, param, isParam := strings.Cut(key, ".")
+		fn := funcs[name]
+		switch {
+		case isParam && fn == nil:
+			errs = append(errs, fmt.Errorf("wide string %s: function not found", key))
+		case isParam:
+			i := paramIndex(fn, param)
+			if i < 0 {
+				errs = append(errs, fmt.Errorf("wide string %s: %s has no parameter %s", key, name, param))
+				continue
+			}
+			if _, isSlice := sliceParams[fn][i]; isSlice || outs[fn] != nil && outs[fn][i] || lists.isListLength(fn, i) {
+				errs = append(errs, fmt.Errorf("wide string %s: %s is a slice or out-parameter", key, param))
+				continue
+			}
+			if err := checkWideString(fn.Params[i].Type, enc); err != nil {
+				errs = append(errs, fmt.Errorf("wide string %s: %w", key, err))
+				continue
+			}
+			if wide.params[fn] == nil {
+				wide.params[fn] = make(map[int]Encoding)
+			}
+			wide.params[fn][i] = enc
+		case fn != nil:
+			if err := checkWideString(fn.Result, enc); err != nil {
+				errs = append(errs, fmt.Errorf("wide string %s: %w", key, err))
+				continue
+			}
+			wide.results[fn] = enc
+		case typedefs[name] != nil:
+			t := typedefs[name]
+			if t.Underlying().Kind != sema.KindPointer {
+				t = &sema.Type{Kind: sema.KindPointer, Elem: t}
+			}
+			if err := checkWideString(t, enc); err != nil {
+				errs = append(errs, fmt.Errorf("wide string %s: %w", key, err))
+				continue
+			}
+			byTypedef[name] = enc
+		default:
+			errs = append(errs, fmt.Errorf("wide string %s: no function or typedef of that name", key))
+		}
+	}
+
+	for _, fn := range module.Functions {
+		if _, ok := wide.results[fn]; !ok {
+			if enc, ok := wideEncoding(fn.Result, byTypedef, false); ok {
+				wide.results[fn] = enc
+			}
+		}
+		for i, p := range fn.Params {
+			if _, ok := wide.params[fn][i]; ok {
+				continue
+			}
+			if _, isSlice := sliceParams[fn][i]; isSlice || outs[fn] != nil && outs[fn][i] || lists.isListLength(fn, i) {
+				continue
+			}
+			if enc, ok := wideEncoding(p.Type, byTypedef, true); ok {
+				if wide.params[fn] == nil {
+					wide.params[fn] = make(map[int]Encoding)
+				}
+				wide.params[fn][i] = enc
+			}
+		}
+	}
+
+	for _, encs := range wide.params {
+		for _, enc := range encs {
+			wide.used[enc] = true
+		}
+	}
+	for _, enc := range wide.results {
+		wide.used[enc] = true
+	}
+
+	return wide, errors.Join(errs...)
+}
+
+// wideEncoding returns the encoding of t if it is a pointer named by a
+// typedef of byTypedef, or a pointer to wchar_t, char16_t or char32_t. Such
+// parameters must point to const.
+func wideEncoding(t *sema.Type, byTypedef map[string]Encoding, param bool) (Encoding, bool) {
+	u := t.Underlying()
+	if u.Kind != sema.KindPointer {
+		return "", false
+	}
+	for _, name := range slices.Concat(typedefNames(t), typedefNames(u.Elem)) {
+		if enc, ok := byTypedef[name]; ok {
+			return enc, true
+		}
+	}
+	if param && !u.Elem.Const {
+		return "", false
+	}
+	switch u.Elem.Underlying().Name {
+	case "wchar_t":
+		return EncodingWChar, true
+	case "char16_t":
+		return EncodingUTF16, true
+	case "char32_t":
+		return EncodingUTF32, true
+	}
+	return "", false
+}
+
+// typedefNames returns the names of the typedefs t goes through.
+func typedefNames(t *sema.Type) []string {
+	var names []string
+	for ; t.Kind == sema.KindTypedef; t = t.Elem {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// checkWideString reports why t cannot hold a string of encoding enc.
+func checkWideString(t *sema.Type, enc Encoding) error {
+	u := t.Underlying()
+	if u.Kind != sema.KindPointer || u.Elem.Underlying().Kind != sema.KindInt {
+		return fmt.Errorf("not a pointer to an integer")
+	}
+	switch size := u.Elem.Underlying().Size; {
+	case enc == EncodingUTF16 && size != 2:
+		return fmt.Errorf("UTF-16 needs 16-bit units, not %d-bit", size*8)
+	case enc == EncodingUTF32 && size != 4:
+		return fmt.Errorf("UTF-32 needs 32-bit units, not %d-bit", size*8)
+	case enc == EncodingWChar && size != 2 && size != 4:
+		return fmt.Errorf("wchar_t needs 16- or 32-bit units, not %d-bit", size*8)
+	}
+	return nil
+}
+
+// wideStringData returns the data of the wide string conversion helpers.
+func (w *wideStrings) wideStringData() WideStringData {
+	return WideStringData{
+		UTF16: w.used[EncodingUTF16] || w.used[EncodingWChar],
+		UTF32: w.used[EncodingUTF32] || w.used[EncodingWChar],
+		WChar: w.used[EncodingWChar],
+	}
+}
@@ -3,63 +3,370 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/ardanlabs/ffi-converter/generator"
 	"github.com/ardanlabs/ffi-converter/parser"
+	"github.com/ardanlabs/ffi-converter/sema"
 )
 
+const usage = `usage:
+  ffi-converter parse [-json] header.h
+  ffi-converter generate [flags]
+  ffi-converter [flags]              (same as generate)
+
+Run "ffi-converter <command> -h" for the flags of a command.
+`
+
 func main() {
-	headerPath := flag.String("header", "", "Path to C header file")
-	outputDir := flag.String("output", ".", "Output directory for generated Go files")
-	packageName := flag.String("package", "bindings", "Go package name")
-	libName := flag.String("lib", "", "Library name (e.g., 'mylib' for libmylib.so)")
-	flag.Parse()
-
-	if *headerPath == "" {
-		fmt.Fprintln(os.Stderr, "error: -header flag is required")
-		flag.Usage()
+	args := os.Args[1:]
+
+	var err error
+	switch {
+	case len(args) > 0 && args[0] == "parse":
+		err = runParse(args[1:])
+	case len(args) > 0 && args[0] == "generate":
+		err = runGenerate(args[1:])
+	case len(args) > 0 && !strings.HasPrefix(args[0], "-"):
+		fmt.Fprintf(os.Stderr, "error: unknown command %q\n\n%s", args[0], usage)
+		os.Exit(2)
+	default:
+		err = runGenerate(args)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
+}
+
+func runParse(args []string) error {
+	fs := flag.NewFlagSet("parse", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the parsed header model as versioned JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("parse takes exactly one header file")
+	}
+
+	header, err := parseHeaderFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return parser.EncodeJSON(os.Stdout, header)
+	}
+
+	for _, s := range header.Structs {
+		if s.IsOpaque {
+			fmt.Printf("handle   %s\n", s.Name)
+			continue
+		}
+		fmt.Printf("struct   %s (%d fields)\n", s.Name, len(s.Fields))
+	}
+	for _, e := range header.Enums {
+		fmt.Printf("enum     %s (%d values)\n", e.Name, len(e.Values))
+	}
+	for _, td := range header.TypeDefs {
+		fmt.Printf("typedef  %s\n", td.Name)
+	}
+	for _, fn := range header.Functions {
+		fmt.Printf("function %s (%d params)\n", fn.Name, len(fn.Params))
+	}
+
+	return nil
+}
+
+func runGenerate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	headerPath := fs.String("header", "", "Path to C header file")
+	modelPath := fs.String("model", "", "Path to a JSON model written by 'parse -json' ('-' for stdin), instead of -header")
+	outputDir := fs.String("output", ".", "Output directory for generated Go files")
+	packageName := fs.String("package", "bindings", "Go package name")
+	libName := fs.String("lib", "", "Library name (e.g., 'mylib' for libmylib.so)")
+	targets := fs.String("targets", "", "Comma-separated GOOS/GOARCH pairs the bindings must support (default: all supported by jupiterrider/ffi)")
+	include := fs.String("include", "", "Comma-separated glob patterns of C declarations to generate (default: all)")
+	exclude := fs.String("exclude", "", "Comma-separated glob patterns of C declarations to skip")
+	templates := fs.String("templates", "", "Directory of <name>.tmpl files overriding the built-in templates")
+	layout := fs.String("layout", "split", "File layout: 'split' (loader.go, types.go, functions.go) or 'single' (<package>.go)")
+	stripPrefix := fs.String("strip-prefix", "", "Comma-separated prefixes removed from C names, e.g. 'calc_' turns calc_add into Add")
+	acronyms := fs.String("acronyms", "", "Comma-separated words written in upper case, added to the built-in list (id, url, http, ...)")
+	trimEnumPrefix := fs.Bool("trim-enum-prefix", false, "Remove the prefix shared by the values of each enum")
+	qualifyEnums := fs.Bool("qualify-enums", false, "Prefix enum values with the Go name of their enum")
+	onCollision := fs.String("on-collision", "error", "What to do when two C names map to one Go name: 'error' or 'suffix' (Foo, Foo2, ...)")
+	methods := fs.Bool("methods", false, "Generate functions whose first parameter is an opaque handle as methods of the handle, e.g. Calc.Add")
+	keepFunctions := fs.Bool("keep-functions", false, "With -methods, also generate the flat functions, forwarding to the methods")
+	detectPairs := fs.Bool("handle-pairs", false, "Wrap opaque handles with a _create/_new/_open and _free/_destroy/_close pair in a Go type with Close")
+	cleanup := fs.Bool("cleanup", false, "Free handles that are garbage collected without Close, logging a leak warning")
+	detectOut := fs.Bool("out-params", false, "Return non-const pointers to numbers, bools and enums, and trailing handle pointers, as Go results")
+	detectSlices := fs.Bool("slices", false, "Pass Go slices to pointer parameters followed by an integer named like a length (count, len, size, ...)")
+	stringBuffers := fs.Bool("string-buffers", false, "Also generate <Name>String wrappers that return the contents of a char buffer, growing it as snprintf reports")
+	statusType := fs.String("status-type", "", "C enum or integer typedef of statuses; functions returning it return a Go error")
+	statusFuncs := fs.String("status-funcs", "", "Comma-separated glob patterns of functions whose integer result is a status")
+	success := fs.String("success", "", "Comma-separated statuses meaning success, as enum values or integers (default: 0)")
+	nonNegative := fs.Bool("non-negative", false, "With status functions, treat results of at least 0 as success and return them with the error")
+	errnoFuncs := fs.String("errno", "", "Comma-separated glob patterns of functions reporting failures through errno, which their wrappers return as a syscall.Errno error")
+	errorMessage := fs.String("error-message", "", "C function returning the message of a failure, taking the status, nothing, or the handle of the call")
+	var countFields, renames, handlePairs, outParams, inParams, sliceParams, stringParams, owned, stringLists, freeStrings, wideStrings stringList
+	fs.Var(&owned, "owned", "Function whose string or pointer result the caller frees, as function=free_function, or function for the C library's free (repeatable)")
+	fs.Var(&stringLists, "string-list", "char** result or parameter taking a []string, as function or function.param, NULL-terminated or with =length naming its length (repeatable)")
+	fs.Var(&freeStrings, "free-strings", "Owned string list result whose strings are freed one by one before the array, as function (repeatable)")
+	fs.Var(&wideStrings, "wide", "Pointer taking or returning a Go string in a 16- or 32-bit encoding, as function.param, function or typedef =utf16, =utf32 or =wchar (repeatable)")
+	fs.Var(&stringParams, "string", "Non-const char pointer passed as a Go string rather than a []byte buffer, as function.param (repeatable)")
+	fs.Var(&sliceParams, "slice", "Pointer and length parameters or struct fields taking a Go slice, as function.pointer=length or struct.pointer=length (repeatable)")
+	fs.Var(&outParams, "out", "Out-parameter returned as a Go result, as function.param (repeatable)")
+	fs.Var(&inParams, "in", "Pointer parameter that is not an out-parameter, as function.param (repeatable)")
+	fs.Var(&handlePairs, "handle-pair", "Constructor and destructor of an opaque handle as create=free (repeatable)")
+	fs.Var(&countFields, "count-field", "Count field of a flexible array member as Struct.member=field (repeatable)")
+	fs.Var(&renames, "rename", "Go name of a C declaration as cname=GoName (repeatable)")
+	fs.Parse(args)
+
+	if (*headerPath == "") == (*modelPath == "") {
+		fs.Usage()
+		return fmt.Errorf("exactly one of -header or -model is required")
+	}
+
+	source := *headerPath
+	if source == "" {
+		source = *modelPath
+	}
 
 	if *libName == "" {
-		base := filepath.Base(*headerPath)
+		if source == "-" {
+			return fmt.Errorf("-lib is required when reading the model from stdin")
+		}
+		base := filepath.Base(source)
 		ext := filepath.Ext(base)
 		*libName = base[:len(base)-len(ext)]
 	}
 
-	headerData, err := os.ReadFile(*headerPath)
+	var header *parser.Header
+	var err error
+	if *headerPath != "" {
+		header, err = parseHeaderFile(*headerPath)
+	} else {
+		header, err = readModelFile(*modelPath)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading header: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+
+	for _, cf := range countFields {
+		if err := setCountField(header, cf); err != nil {
+			return fmt.Errorf("-count-field %s: %w", cf, err)
+		}
+	}
+
+	module, err := sema.Resolve(header)
+	if err != nil {
+		return fmt.Errorf("resolving header:\n%w", err)
+	}
+
+	opts := generator.Options{
+		Package: *packageName,
+		LibName: *libName,
+		Targets: splitList(*targets),
+		Include: splitList(*include),
+		Exclude: splitList(*exclude),
+		Layout:  generator.Layout(*layout),
+
+		HandleMethods:     *methods,
+		KeepFunctions:     *keepFunctions,
+		DetectHandlePairs: *detectPairs,
+		CleanupHandles:    *cleanup,
+		OutParams:         outParams,
+		InParams:          inParams,
+		DetectOutParams:   *detectOut,
+		DetectSlices:      *detectSlices,
+		Errno:             splitList(*errnoFuncs),
+		StringParams:      stringParams,
+		StringBuffers:     *stringBuffers,
+
+		Naming: generator.NamingOptions{
+			Renames:           make(map[string]string),
+			StripPrefixes:     splitList(*stripPrefix),
+			TrimEnumPrefix:    *trimEnumPrefix,
+			QualifyEnumValues: *qualifyEnums,
+			OnCollision:       generator.Collision(*onCollision),
+		},
+	}
+	for _, p := range handlePairs {
+		ctor, dtor, ok := strings.Cut(p, "=")
+		if !ok || ctor == "" || dtor == "" {
+			return fmt.Errorf("-handle-pair %s: expected create=free", p)
+		}
+		opts.HandlePairs = append(opts.HandlePairs, generator.HandlePair{Constructor: ctor, Destructor: dtor})
+	}
+	for _, sp := range sliceParams {
+		ptr, length, ok := strings.Cut(sp, "=")
+		fn, ptr, ok2 := strings.Cut(ptr, ".")
+		if !ok || !ok2 || fn == "" || ptr == "" || length == "" {
+			return fmt.Errorf("-slice %s: expected function.pointer=length", sp)
+		}
+		opts.SliceParams = append(opts.SliceParams, generator.SliceParam{Function: fn, Pointer: ptr, Length: length})
+	}
+	if len(owned) > 0 {
+		opts.OwnedResults = make(map[string]string)
+	}
+	for _, o := range owned {
+		fn, free, ok := strings.Cut(o, "=")
+		if !ok {
+			free = "free"
+		}
+		if fn == "" || free == "" {
+			return fmt.Errorf("-owned %s: expected function or function=free_function", o)
+		}
+		opts.OwnedResults[fn] = free
+	}
+	if len(stringLists) > 0 {
+		opts.StringLists = make(map[string]generator.StringList)
+	}
+	for _, sl := range stringLists {
+		key, length, _ := strings.Cut(sl, "=")
+		if key == "" {
+			return fmt.Errorf("-string-list %s: expected function or function.param, optionally =length", sl)
+		}
+		opts.StringLists[key] = generator.StringList{Length: length, FreeStrings: slices.Contains(freeStrings, key)}
+	}
+	for _, fn := range freeStrings {
+		if _, ok := opts.StringLists[fn]; !ok {
+			return fmt.Errorf("-free-strings %s: not a -string-list", fn)
+		}
+	}
+	if len(wideStrings) > 0 {
+		opts.WideStrings = make(map[string]generator.Encoding)
+	}
+	for _, ws := range wideStrings {
+		key, enc, ok := strings.Cut(ws, "=")
+		if key == "" || !ok {
+			return fmt.Errorf("-wide %s: expected function.param, function or typedef =utf16, =utf32 or =wchar", ws)
+		}
+		opts.WideStrings[key] = generator.Encoding(enc)
+	}
+	if *statusType != "" || *statusFuncs != "" {
+		opts.Errors = &generator.ErrorConvention{
+			Status:      *statusType,
+			Functions:   splitList(*statusFuncs),
+			Success:     splitList(*success),
+			NonNegative: *nonNegative,
+			Message:     *errorMessage,
+		}
+	}
+	if *acronyms != "" {
+		opts.Naming.Acronyms = append(slices.Clone(generator.DefaultAcronyms), splitList(*acronyms)...)
+	}
+	if *templates != "" {
+		opts.Templates = os.DirFS(*templates)
+	}
+	for _, r := range renames {
+		cName, goName, ok := strings.Cut(r, "=")
+		if !ok || cName == "" || goName == "" {
+			return fmt.Errorf("-rename %s: expected cname=GoName", r)
+		}
+		opts.Naming.Renames[cName] = goName
+	}
+
+	gen, err := generator.New(module, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := gen.GenerateTo(printingWriter{generator.DirWriter(*outputDir)}); err != nil {
+		return fmt.Errorf("generating code: %w", err)
+	}
+
+	return nil
+}
+
+// printingWriter writes files into a directory and prints each path.
+type printingWriter struct {
+	dir generator.DirWriter
+}
+
+func (w printingWriter) WriteFile(name string, data []byte) error {
+	if err := w.dir.WriteFile(name, data); err != nil {
+		return err
+	}
+	fmt.Printf("Generated: %s\n", filepath.Join(string(w.dir), name))
+	return nil
+}
+
+func parseHeaderFile(path string) (*parser.Header, error) {
+	headerData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
 	}
 
 	header, err := parser.Parse(string(headerData))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing header: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("parsing header: %w", err)
 	}
 
-	gen := generator.New(*packageName, *libName, header)
+	return header, nil
+}
 
-	if err := os.MkdirAll(*outputDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "error creating output directory: %v\n", err)
-		os.Exit(1)
+func readModelFile(path string) (*parser.Header, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading model: %w", err)
+		}
+		defer f.Close()
+		r = f
 	}
 
-	files, err := gen.Generate()
+	header, err := parser.DecodeJSON(r)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error generating code: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("reading model %s: %w", path, err)
+	}
+
+	return header, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func setCountField(header *parser.Header, spec string) error {
+	member, countField, ok := strings.Cut(spec, "=")
+	structName, memberName, ok2 := strings.Cut(member, ".")
+	if !ok || !ok2 {
+		return fmt.Errorf("expected Struct.member=field")
 	}
 
-	for filename, content := range files {
-		path := filepath.Join(*outputDir, filename)
-		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "error writing %s: %v\n", filename, err)
-			os.Exit(1)
+	for i, s := range header.Structs {
+		if s.Name != structName {
+			continue
+		}
+		for j, f := range s.Fields {
+			if f.Name == memberName && f.Type.IsFlexible {
+				header.Structs[i].Fields[j].CountField = countField
+				return nil
+			}
 		}
-		fmt.Printf("Generated: %s\n", path)
+		return fmt.Errorf("struct %s has no flexible array member %s", structName, memberName)
 	}
+
+	return fmt.Errorf("struct %s not found", structName)
 }
@@ -0,0 +1,47 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ModelVersion is the version of the JSON header model. It is bumped
+// whenever a field changes meaning or is removed; new optional fields do not
+// change it.
+const ModelVersion = 1
+
+type model struct {
+	Version int     `json:"version"`
+	Header  *Header `json:"header"`
+}
+
+// EncodeJSON writes header as an indented, versioned JSON document.
+func EncodeJSON(w io.Writer, header *Header) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(model{Version: ModelVersion, Header: header})
+}
+
+// DecodeJSON reads a header written by EncodeJSON. Unknown fields are
+// rejected so that typos in hand-edited models are not silently ignored.
+func DecodeJSON(r io.Reader) (*Header, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var m model
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("decoding model: %w", err)
+	}
+
+	if m.Version != ModelVersion {
+		return nil, fmt.Errorf("unsupported model version %d, expected %d", m.Version, ModelVersion)
+	}
+
+	if m.Header == nil {
+		return nil, fmt.Errorf("model has no header")
+	}
+
+	return m.Header, nil
+}
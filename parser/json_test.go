@@ -0,0 +1,58 @@
+package parser
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	src, err := os.ReadFile("../testdata/calculator.h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := Parse(string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeJSON(&buf, h); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("../testdata/calculator.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(want) {
+		t.Errorf("model of calculator.h differs from testdata/calculator.json:\n%s", buf.String())
+	}
+
+	got, err := DecodeJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("decoded %+v, want %+v", got, h)
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{`{"version": 2, "header": {}}`, "unsupported model version 2"},
+		{`{"version": 1}`, "model has no header"},
+		{`{"version": 1, "header": {"structz": []}}`, `unknown field "structz"`},
+	}
+
+	for _, tt := range tests {
+		_, err := DecodeJSON(strings.NewReader(tt.model))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.model, err, tt.want)
+		}
+	}
+}
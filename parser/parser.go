@@ -2,17 +2,33 @@ package parser
 
 import (
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 )
 
+// maxAlignment is the alignment used for a bare __attribute__((aligned)),
+// which GCC and Clang define as the largest alignment of any scalar type.
+const maxAlignment = 16
+
+const attrPattern = `__attribute__\s*\(\((?:[^()]|\([^()]*\))*\)\)`
+
 var blockCommentRe = regexp.MustCompile(`/\*[\s\S]*?\*/`)
 var lineCommentRe = regexp.MustCompile(`//[^\n]*`)
 var multiSpaceRe = regexp.MustCompile(`[ \t]+`)
-var typedefRe = regexp.MustCompile(`typedef\s+(?:struct\s+)?(\w+(?:\s*\*)?)\s+(\w+)\s*;`)
+var typedefRe = regexp.MustCompile(`typedef\s+(?:struct\s+)?((?:const\s+)?\w+(?:\s*\*)?)\s+(\w+)\s*;`)
 var opaqueRe = regexp.MustCompile(`typedef\s+struct\s+(\w+)_s\s*\*\s*(\w+)\s*;`)
-var structRe = regexp.MustCompile(`typedef\s+struct\s*(?:\w+)?\s*\{([^}]+)\}\s*(\w+)\s*;`)
+var structRe = regexp.MustCompile(`typedef\s+struct\s*((?:` + attrPattern + `\s*)*)(?:\w+)?\s*((?:` + attrPattern + `\s*)*)\{([^}]+)\}\s*((?:` + attrPattern + `\s*)*)(\w+)\s*;`)
 var enumRe = regexp.MustCompile(`typedef\s+enum\s*(?:\w+)?\s*\{([^}]+)\}\s*(\w+)\s*;`)
-var funcRe = regexp.MustCompile(`(?m)^[ \t]*((?:const\s+)?(?:unsigned\s+)?(?:struct\s+)?\w+(?:\s*\*)?)\s+(\w+)\s*\(([^)]*)\)\s*;`)
+var pragmaPackRe = regexp.MustCompile(`#pragma\s+pack\s*\(([^)]*)\)`)
+var alignedAttrRe = regexp.MustCompile(`aligned\s*(?:\(\s*(\d+)\s*\))?`)
+var alignasRe = regexp.MustCompile(`(?:_Alignas|alignas)\s*\(\s*(\d+)\s*\)`)
+var arrayRe = regexp.MustCompile(`^(\**)(\w+)\[(\w*)\]$`)
+var bracketSpaceRe = regexp.MustCompile(`\s*\[\s*(\w*)\s*\]`)
+var defineRe = regexp.MustCompile(`(?m)^[ \t]*#define\s+(\w+)\s+\(?(\d+)\)?[ \t]*$`)
+var sizeAnnotationRe = regexp.MustCompile(`\b(_In_reads|_Inout_updates|_Out_writes)(?:_opt)?_\s*\(\s*(\w+)\s*\)`)
+var complexRe = regexp.MustCompile(`\b(?:_Complex|complex)\b`)
+var funcRe = regexp.MustCompile(`(?m)^[ \t]*((?:const\s+)?(?:unsigned\s+)?(?:struct\s+)?(?:(?:_Complex|complex)\s+)?\w+(?:\s+(?:_Complex|complex))?(?:(?:\s*\*)+\s*|\s+))(\w+)\s*\(((?:[^()]|\([^()]*\))*)\)\s*;`)
 
 func Parse(content string) (*Header, error) {
 	content = removeComments(content)
@@ -76,25 +92,95 @@ func parseTypeDefs(content string, header *Header) {
 }
 
 func parseStructs(content string, header *Header) {
-	matches := structRe.FindAllStringSubmatch(content, -1)
+	defines := parseDefines(content)
+	matches := structRe.FindAllStringSubmatchIndex(content, -1)
 
-	for _, m := range matches {
-		if len(m) < 3 {
+	for _, loc := range matches {
+		if len(loc) < 12 {
 			continue
 		}
-		body := strings.TrimSpace(m[1])
-		name := strings.TrimSpace(m[2])
+		attrs := content[loc[2]:loc[3]] + content[loc[4]:loc[5]] + content[loc[8]:loc[9]]
+		body := strings.TrimSpace(content[loc[6]:loc[7]])
+		name := strings.TrimSpace(content[loc[10]:loc[11]])
 
-		fields := parseStructFields(body)
+		fields := parseStructFields(body, defines)
+
+		pack := packAt(content, loc[0])
+		if strings.Contains(attrs, "packed") {
+			pack = 1
+		}
 
 		header.Structs = append(header.Structs, Struct{
 			Name:   name,
 			Fields: fields,
+			Pack:   pack,
+			Align:  parseAlignedAttr(attrs),
 		})
 	}
 }
 
-func parseStructFields(body string) []StructField {
+// packAt returns the #pragma pack value in effect at offset, or 0 when the
+// compiler's natural packing applies.
+func packAt(content string, offset int) int {
+	var stack []int
+	current := 0
+
+	for _, m := range pragmaPackRe.FindAllStringSubmatchIndex(content, -1) {
+		if m[0] >= offset {
+			break
+		}
+
+		args := strings.Split(content[m[2]:m[3]], ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+
+		switch args[0] {
+		case "push":
+			stack = append(stack, current)
+			if len(args) > 1 {
+				current, _ = strconv.Atoi(args[len(args)-1])
+			}
+		case "pop":
+			current = 0
+			if len(stack) > 0 {
+				current = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "":
+			current = 0
+		default:
+			current, _ = strconv.Atoi(args[0])
+		}
+	}
+
+	return current
+}
+
+func parseAlignedAttr(attrs string) int {
+	m := alignedAttrRe.FindStringSubmatch(attrs)
+	if m == nil {
+		return 0
+	}
+	if m[1] == "" {
+		return maxAlignment
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+func parseDefines(content string) map[string]int {
+	defines := make(map[string]int)
+	for _, m := range defineRe.FindAllStringSubmatch(content, -1) {
+		n, err := strconv.Atoi(m[2])
+		if err == nil {
+			defines[m[1]] = n
+		}
+	}
+	return defines
+}
+
+func parseStructFields(body string, defines map[string]int) []StructField {
 	var fields []StructField
 
 	lines := strings.Split(body, ";")
@@ -104,31 +190,82 @@ func parseStructFields(body string) []StructField {
 			continue
 		}
 
+		align := 0
+		if m := alignasRe.FindStringSubmatch(line); m != nil {
+			align, _ = strconv.Atoi(m[1])
+			line = strings.TrimSpace(alignasRe.ReplaceAllString(line, ""))
+		}
+
+		line = bracketSpaceRe.ReplaceAllString(line, "[$1]")
+
 		parts := strings.Fields(line)
 		if len(parts) < 2 {
 			continue
 		}
 
 		name := parts[len(parts)-1]
-		name = strings.TrimPrefix(name, "*")
-		typeParts := parts[:len(parts)-1]
+		arrayLen := ""
+		isArray := false
+		if m := arrayRe.FindStringSubmatch(name); m != nil {
+			name = m[1] + m[2]
+			arrayLen = m[3]
+			isArray = true
+		}
 
-		if strings.HasPrefix(parts[len(parts)-1], "*") {
-			typeParts = append(typeParts, "*")
+		// Stars written against the name, as in char **names, belong to
+		// the type.
+		typeParts := parts[:len(parts)-1]
+		if stars := len(name) - len(strings.TrimLeft(name, "*")); stars > 0 {
+			typeParts = append(typeParts, strings.Repeat("*", stars))
+			name = name[stars:]
 		}
 
 		typeStr := strings.Join(typeParts, " ")
 		ctype := parseCType(typeStr)
 
+		if isArray {
+			ctype.IsArray = true
+			if n, err := strconv.Atoi(arrayLen); err == nil {
+				ctype.ArraySize = n
+			} else if n, ok := defines[arrayLen]; ok {
+				ctype.ArraySize = n
+			}
+			ctype.IsFlexible = arrayLen == ""
+		}
+
 		fields = append(fields, StructField{
-			Name: name,
-			Type: ctype,
+			Name:  name,
+			Type:  ctype,
+			Align: align,
 		})
 	}
 
+	if n := len(fields); n > 0 && fields[n-1].Type.IsFlexible {
+		fields[n-1].CountField = guessCountField(fields[:n-1], fields[n-1].Name)
+	}
+
 	return fields
 }
 
+// guessCountField picks the header field that most likely holds the element
+// count of a trailing flexible array member.
+func guessCountField(fields []StructField, member string) string {
+	candidates := []string{
+		member + "_count", "num_" + member, "n_" + member, member + "_len",
+		"count", "len", "length", "size", "num", "n",
+	}
+
+	for _, c := range candidates {
+		for _, f := range fields {
+			if strings.EqualFold(f.Name, c) && !f.Type.IsPointer && !f.Type.IsArray {
+				return f.Name
+			}
+		}
+	}
+
+	return ""
+}
+
 func parseCType(typeStr string) CType {
 	typeStr = strings.TrimSpace(typeStr)
 
@@ -140,6 +277,14 @@ func parseCType(typeStr string) CType {
 		typeStr = strings.TrimSpace(typeStr)
 	}
 
+	if complexRe.MatchString(typeStr) {
+		ct.IsComplex = true
+		typeStr = strings.TrimSpace(complexRe.ReplaceAllString(typeStr, ""))
+		if typeStr == "" {
+			typeStr = "double"
+		}
+	}
+
 	if strings.Contains(typeStr, "unsigned") {
 		ct.IsUnsigned = true
 		typeStr = strings.ReplaceAll(typeStr, "unsigned", "")
@@ -148,10 +293,16 @@ func parseCType(typeStr string) CType {
 
 	if strings.HasSuffix(typeStr, "*") || strings.Contains(typeStr, "* ") {
 		ct.IsPointer = true
+		if n := strings.Count(typeStr, "*"); n > 1 {
+			ct.Depth = n
+		}
 		typeStr = strings.ReplaceAll(typeStr, "*", "")
 		typeStr = strings.TrimSpace(typeStr)
 	}
 
+	typeStr = strings.TrimPrefix(typeStr, "struct ")
+	typeStr = strings.TrimPrefix(typeStr, "enum ")
+
 	ct.Name = strings.TrimSpace(typeStr)
 
 	return ct
@@ -225,6 +376,30 @@ func parseFunctions(content string, header *Header) {
 	}
 }
 
+// sizeDirections are the directions of the SAL buffer annotations, such as
+// _In_reads_(count), that name the parameter holding the element count.
+var sizeDirections = map[string]string{
+	"_In_reads":      "in",
+	"_Inout_updates": "inout",
+	"_Out_writes":    "out",
+}
+
+// directionAnnotations are the parameter annotation macros of SAL and common
+// C libraries, which headers define away for the compiler.
+var directionAnnotations = map[string]string{
+	"_In_":      "in",
+	"_In_opt_":  "in",
+	"IN":        "in",
+	"__in":      "in",
+	"_Out_":     "out",
+	"_Out_opt_": "out",
+	"OUT":       "out",
+	"__out":     "out",
+	"_Inout_":   "inout",
+	"INOUT":     "inout",
+	"__inout":   "inout",
+}
+
 func parseParams(paramsStr string) ([]FunctionParam, bool) {
 	var params []FunctionParam
 	isVariadic := false
@@ -241,28 +416,45 @@ func parseParams(paramsStr string) ([]FunctionParam, bool) {
 			continue
 		}
 
-		tokens := strings.Fields(part)
-		if len(tokens) < 2 {
+		direction, length := "", ""
+		if m := sizeAnnotationRe.FindStringSubmatch(part); m != nil {
+			direction, length = sizeDirections[m[1]], m[2]
+			part = sizeAnnotationRe.ReplaceAllString(part, "")
+		}
+
+		tokens := slices.DeleteFunc(strings.Fields(part), func(tok string) bool {
+			if d, ok := directionAnnotations[tok]; ok {
+				direction = d
+				return true
+			}
+			return false
+		})
+		part = strings.Join(tokens, " ")
+
+		if len(tokens) < 2 || complexRe.MatchString(tokens[len(tokens)-1]) {
 			params = append(params, FunctionParam{
-				Name: "",
-				Type: parseCType(part),
+				Name:      "",
+				Type:      parseCType(part),
+				Direction: direction,
+				Length:    length,
 			})
 			continue
 		}
 
 		name := tokens[len(tokens)-1]
-		name = strings.TrimPrefix(name, "*")
 		typeParts := tokens[:len(tokens)-1]
-
-		if strings.HasPrefix(tokens[len(tokens)-1], "*") {
-			typeParts = append(typeParts, "*")
+		if stars := len(name) - len(strings.TrimLeft(name, "*")); stars > 0 {
+			typeParts = append(typeParts, strings.Repeat("*", stars))
+			name = name[stars:]
 		}
 
 		typeStr := strings.Join(typeParts, " ")
 
 		params = append(params, FunctionParam{
-			Name: name,
-			Type: parseCType(typeStr),
+			Name:      name,
+			Type:      parseCType(typeStr),
+			Direction: direction,
+			Length:    length,
 		})
 	}
 
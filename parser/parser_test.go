@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPointerDepth(t *testing.T) {
+	tests := []struct {
+		decl string
+		name string
+		want CType
+	}{
+		{"void f(char* s);", "s", CType{Name: "char", IsPointer: true}},
+		{"void f(char *s);", "s", CType{Name: "char", IsPointer: true}},
+		{"void f(char * s);", "s", CType{Name: "char", IsPointer: true}},
+		{"void f(const char** paths);", "paths", CType{Name: "char", IsPointer: true, Depth: 2, IsConst: true}},
+		{"void f(const char **paths);", "paths", CType{Name: "char", IsPointer: true, Depth: 2, IsConst: true}},
+		{"void f(const char * *paths);", "paths", CType{Name: "char", IsPointer: true, Depth: 2, IsConst: true}},
+		{"void f(int ***p);", "p", CType{Name: "int", IsPointer: true, Depth: 3}},
+	}
+
+	for _, tt := range tests {
+		h, err := Parse(tt.decl)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.decl, err)
+		}
+		if len(h.Functions) != 1 || len(h.Functions[0].Params) != 1 {
+			t.Fatalf("%s: parsed %+v", tt.decl, h.Functions)
+		}
+		p := h.Functions[0].Params[0]
+		if p.Name != tt.name || !reflect.DeepEqual(p.Type, tt.want) {
+			t.Errorf("%s: got %s %+v, want %s %+v", tt.decl, p.Name, p.Type, tt.name, tt.want)
+		}
+	}
+}
+
+func TestFieldPointerDepth(t *testing.T) {
+	h, err := Parse("typedef struct { char **names; size_t count; const char *label; } Names;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StructField{
+		{Name: "names", Type: CType{Name: "char", IsPointer: true, Depth: 2}},
+		{Name: "count", Type: CType{Name: "size_t"}},
+		{Name: "label", Type: CType{Name: "char", IsPointer: true, IsConst: true}},
+	}
+	if len(h.Structs) != 1 || !reflect.DeepEqual(h.Structs[0].Fields, want) {
+		t.Errorf("got %+v, want %+v", h.Structs, want)
+	}
+}
+
+func TestReturnPointerDepth(t *testing.T) {
+	h, err := Parse("char **list(void);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CType{Name: "char", IsPointer: true, Depth: 2}
+	if len(h.Functions) != 1 || h.Functions[0].Name != "list" || !reflect.DeepEqual(h.Functions[0].ReturnType, want) {
+		t.Errorf("got %+v, want list returning %+v", h.Functions, want)
+	}
+}
+
+func TestDirectionAnnotations(t *testing.T) {
+	tests := []struct {
+		decl string
+		want FunctionParam
+	}{
+		{"void f(int* n);", FunctionParam{Name: "n", Type: CType{Name: "int", IsPointer: true}}},
+		{"void f(_In_ const int* n);", FunctionParam{Name: "n", Type: CType{Name: "int", IsPointer: true, IsConst: true}, Direction: "in"}},
+		{"void f(_Out_ int* n);", FunctionParam{Name: "n", Type: CType{Name: "int", IsPointer: true}, Direction: "out"}},
+		{"void f(_Out_opt_ int *n);", FunctionParam{Name: "n", Type: CType{Name: "int", IsPointer: true}, Direction: "out"}},
+		{"void f(OUT int* n);", FunctionParam{Name: "n", Type: CType{Name: "int", IsPointer: true}, Direction: "out"}},
+		{"void f(__inout int* n);", FunctionParam{Name: "n", Type: CType{Name: "int", IsPointer: true}, Direction: "inout"}},
+		{"void f(_Out_ int*);", FunctionParam{Type: CType{Name: "int", IsPointer: true}, Direction: "out"}},
+	}
+
+	for _, tt := range tests {
+		h, err := Parse(tt.decl)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.decl, err)
+		}
+		if len(h.Functions) != 1 || len(h.Functions[0].Params) != 1 {
+			t.Fatalf("%s: parsed %+v", tt.decl, h.Functions)
+		}
+		if got := h.Functions[0].Params[0]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.decl, got, tt.want)
+		}
+	}
+}
+
+func TestSizeAnnotations(t *testing.T) {
+	tests := []struct {
+		decl string
+		want FunctionParam
+	}{
+		{"void f(_In_reads_(n) const int* p, int n);", FunctionParam{Name: "p", Type: CType{Name: "int", IsPointer: true, IsConst: true}, Direction: "in", Length: "n"}},
+		{"void f(_In_reads_opt_( n ) const int* p, int n);", FunctionParam{Name: "p", Type: CType{Name: "int", IsPointer: true, IsConst: true}, Direction: "in", Length: "n"}},
+		{"void f(_Out_writes_(size) char *buf, int size);", FunctionParam{Name: "buf", Type: CType{Name: "char", IsPointer: true}, Direction: "out", Length: "size"}},
+		{"void f(_Inout_updates_(count) double* data, int count);", FunctionParam{Name: "data", Type: CType{Name: "double", IsPointer: true}, Direction: "inout", Length: "count"}},
+	}
+
+	for _, tt := range tests {
+		h, err := Parse(tt.decl)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.decl, err)
+		}
+		if len(h.Functions) != 1 || len(h.Functions[0].Params) != 2 {
+			t.Fatalf("%s: parsed %+v", tt.decl, h.Functions)
+		}
+		if got := h.Functions[0].Params[0]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.decl, got, tt.want)
+		}
+	}
+}
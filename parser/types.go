@@ -1,56 +1,66 @@
 package parser
 
 type CType struct {
-	Name       string
-	IsPointer  bool
-	IsConst    bool
-	IsUnsigned bool
-	IsArray    bool
-	ArraySize  int
+	Name       string `json:"name"`
+	IsPointer  bool   `json:"pointer,omitempty"`
+	Depth      int    `json:"depth,omitempty"` // levels of indirection of pointers to pointers, e.g. 2 for char**
+	IsConst    bool   `json:"const,omitempty"`
+	IsUnsigned bool   `json:"unsigned,omitempty"`
+	IsComplex  bool   `json:"complex,omitempty"`
+	IsArray    bool   `json:"array,omitempty"`
+	ArraySize  int    `json:"array_size,omitempty"`
+	IsFlexible bool   `json:"flexible,omitempty"` // trailing flexible array member, declared as T name[]
 }
 
 type StructField struct {
-	Name string
-	Type CType
+	Name  string `json:"name"`
+	Type  CType  `json:"type"`
+	Align int    `json:"align,omitempty"` // explicit alignment from _Alignas; 0 if none
+
+	CountField string `json:"count_field,omitempty"` // field holding the element count of a flexible array
 }
 
 type Struct struct {
-	Name     string
-	TypeDef  string
-	Fields   []StructField
-	IsOpaque bool
+	Name     string        `json:"name"`
+	TypeDef  string        `json:"typedef,omitempty"`
+	Fields   []StructField `json:"fields,omitempty"`
+	IsOpaque bool          `json:"opaque,omitempty"`
+	Pack     int           `json:"pack,omitempty"`  // maximum field alignment; 0 means natural packing
+	Align    int           `json:"align,omitempty"` // explicit alignment from __attribute__((aligned)); 0 if none
 }
 
 type FunctionParam struct {
-	Name string
-	Type CType
+	Name      string `json:"name,omitempty"`
+	Type      CType  `json:"type"`
+	Direction string `json:"direction,omitempty"` // "in", "out" or "inout" when annotated
+	Length    string `json:"length,omitempty"`    // parameter holding the element count, from SAL size annotations
 }
 
 type Function struct {
-	Name       string
-	ReturnType CType
-	Params     []FunctionParam
-	IsVariadic bool
+	Name       string          `json:"name"`
+	ReturnType CType           `json:"return_type"`
+	Params     []FunctionParam `json:"params,omitempty"`
+	IsVariadic bool            `json:"variadic,omitempty"`
 }
 
 type TypeDef struct {
-	Name       string
-	SourceType CType
+	Name       string `json:"name"`
+	SourceType CType  `json:"source_type"`
 }
 
 type EnumValue struct {
-	Name  string
-	Value string
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
 }
 
 type Enum struct {
-	Name   string
-	Values []EnumValue
+	Name   string      `json:"name"`
+	Values []EnumValue `json:"values"`
 }
 
 type Header struct {
-	Structs   []Struct
-	Functions []Function
-	TypeDefs  []TypeDef
-	Enums     []Enum
+	Structs   []Struct   `json:"structs,omitempty"`
+	Functions []Function `json:"functions,omitempty"`
+	TypeDefs  []TypeDef  `json:"typedefs,omitempty"`
+	Enums     []Enum     `json:"enums,omitempty"`
 }
@@ -0,0 +1,461 @@
+package sema
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ardanlabs/ffi-converter/parser"
+)
+
+type primitive struct {
+	kind   Kind
+	size   int
+	signed bool
+}
+
+// primitives describes the scalar types of the LP64 data model used by every
+// 64-bit Unix target.
+var primitives = map[string]primitive{
+	"void":          {KindVoid, 0, false},
+	"bool":          {KindBool, 1, false},
+	"_Bool":         {KindBool, 1, false},
+	"char":          {KindInt, 1, true},
+	"signed char":   {KindInt, 1, true},
+	"short":         {KindInt, 2, true},
+	"short int":     {KindInt, 2, true},
+	"":              {KindInt, 4, true},
+	"int":           {KindInt, 4, true},
+	"signed":        {KindInt, 4, true},
+	"long":          {KindInt, 8, true},
+	"long int":      {KindInt, 8, true},
+	"long long":     {KindInt, 8, true},
+	"long long int": {KindInt, 8, true},
+	"int8_t":        {KindInt, 1, true},
+	"uint8_t":       {KindInt, 1, false},
+	"int16_t":       {KindInt, 2, true},
+	"uint16_t":      {KindInt, 2, false},
+	"int32_t":       {KindInt, 4, true},
+	"uint32_t":      {KindInt, 4, false},
+	"int64_t":       {KindInt, 8, true},
+	"uint64_t":      {KindInt, 8, false},
+	"size_t":        {KindInt, 8, false},
+	"ssize_t":       {KindInt, 8, true},
+	"intptr_t":      {KindInt, 8, true},
+	"uintptr_t":     {KindInt, 8, false},
+	"ptrdiff_t":     {KindInt, 8, true},
+	"wchar_t":       {KindInt, 4, true},
+	"char16_t":      {KindInt, 2, false},
+	"char32_t":      {KindInt, 4, false},
+	"float":         {KindFloat, 4, true},
+	"double":        {KindFloat, 8, true},
+}
+
+type resolver struct {
+	structDecls  map[string]parser.Struct
+	enumDecls    map[string]parser.Enum
+	typedefDecls map[string]parser.TypeDef
+
+	structs  map[string]*Struct
+	refs     map[string]*Struct
+	enums    map[string]*Enum
+	typedefs map[string]*Type
+	visiting map[string]bool
+	deferred []*Type
+
+	errs []error
+}
+
+// Resolve links every type reference in header to its declaration and
+// computes sizes, alignments and field offsets. It reports undefined,
+// ambiguous and recursive types.
+func Resolve(header *parser.Header) (*Module, error) {
+	r := resolver{
+		structDecls:  make(map[string]parser.Struct),
+		enumDecls:    make(map[string]parser.Enum),
+		typedefDecls: make(map[string]parser.TypeDef),
+		structs:      make(map[string]*Struct),
+		refs:         make(map[string]*Struct),
+		enums:        make(map[string]*Enum),
+		typedefs:     make(map[string]*Type),
+		visiting:     make(map[string]bool),
+	}
+
+	r.declare(header)
+
+	var mod Module
+
+	for _, s := range header.Structs {
+		if rs := r.resolveStruct(s.Name); !slices.Contains(mod.Structs, rs) {
+			mod.Structs = append(mod.Structs, rs)
+		}
+	}
+
+	for _, e := range header.Enums {
+		if _, ok := r.enumDecls[e.Name]; !ok {
+			continue
+		}
+		if re := r.resolveEnum(e.Name); !slices.Contains(mod.Enums, re) {
+			mod.Enums = append(mod.Enums, re)
+		}
+	}
+
+	for _, td := range header.TypeDefs {
+		if _, ok := r.typedefDecls[td.Name]; !ok {
+			continue
+		}
+		if rt := r.resolveTypedef(td.Name); !slices.Contains(mod.Typedefs, rt) {
+			mod.Typedefs = append(mod.Typedefs, rt)
+		}
+	}
+
+	for _, fn := range header.Functions {
+		mod.Functions = append(mod.Functions, r.resolveFunction(fn))
+	}
+
+	// Structs referred to through pointers have been laid out by now.
+	for _, t := range r.deferred {
+		if t.Kind == KindStruct {
+			t.Size, t.Align = t.Struct.Size, t.Struct.Align
+		} else {
+			t.Size, t.Align = t.Elem.Size, t.Elem.Align
+		}
+	}
+
+	if len(r.errs) > 0 {
+		return nil, errors.Join(r.errs...)
+	}
+
+	return &mod, nil
+}
+
+func (r *resolver) errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Errorf(format, args...))
+}
+
+func (r *resolver) declare(header *parser.Header) {
+	for _, s := range header.Structs {
+		if _, ok := r.structDecls[s.Name]; ok {
+			r.errorf("ambiguous type %s: declared as struct more than once", s.Name)
+			continue
+		}
+		r.structDecls[s.Name] = s
+	}
+
+	for _, e := range header.Enums {
+		if _, ok := r.structDecls[e.Name]; ok {
+			r.errorf("ambiguous type %s: declared as both struct and enum", e.Name)
+			continue
+		}
+		if _, ok := r.enumDecls[e.Name]; ok {
+			r.errorf("ambiguous type %s: declared as enum more than once", e.Name)
+			continue
+		}
+		r.enumDecls[e.Name] = e
+	}
+
+	// The parser records "typedef struct X_s* X" both as an opaque struct
+	// and as a typedef, so a typedef naming a struct or enum is the same
+	// declaration seen twice rather than an ambiguity.
+	for _, td := range header.TypeDefs {
+		if _, ok := r.structDecls[td.Name]; ok {
+			continue
+		}
+		if _, ok := r.enumDecls[td.Name]; ok {
+			continue
+		}
+		if prev, ok := r.typedefDecls[td.Name]; ok {
+			if prev.SourceType != td.SourceType {
+				r.errorf("ambiguous type %s: declared by conflicting typedefs", td.Name)
+			}
+			continue
+		}
+		r.typedefDecls[td.Name] = td
+	}
+}
+
+// resolveType resolves a type reference. where names the reference in error
+// messages.
+func (r *resolver) resolveType(ct parser.CType, where string) *Type {
+	return r.resolveRef(ct, where, false)
+}
+
+// resolveRef is resolveType for a reference that may sit behind a pointer,
+// in which case the struct it names is linked without being laid out. That
+// lets a struct point to itself or to a struct that contains it.
+func (r *resolver) resolveRef(ct parser.CType, where string, ref bool) *Type {
+	t := r.resolveNamed(ct, where, ct.IsPointer || ref && !ct.IsArray)
+	t.Const = ct.IsConst && !ct.IsPointer
+
+	if ct.IsPointer {
+		t.Const = ct.IsConst
+		t = &Type{Kind: KindPointer, Size: 8, Align: 8, Elem: t}
+		for range ct.Depth - 1 {
+			t = &Type{Kind: KindPointer, Size: 8, Align: 8, Elem: t}
+		}
+	}
+
+	if ct.IsArray {
+		t = &Type{
+			Kind:     KindArray,
+			Size:     t.Size * ct.ArraySize,
+			Align:    t.Align,
+			Elem:     t,
+			Len:      ct.ArraySize,
+			Flexible: ct.IsFlexible,
+		}
+	}
+
+	return t
+}
+
+// resolveValue resolves a type reference that is used by value and must
+// therefore be complete.
+func (r *resolver) resolveValue(ct parser.CType, where string) *Type {
+	t := r.resolveType(ct, where)
+
+	if u := t.Underlying(); u.Kind == KindIncomplete {
+		r.errorf("%s: undefined type %s", where, u.Name)
+	}
+
+	return t
+}
+
+func (r *resolver) resolveNamed(ct parser.CType, where string, ref bool) *Type {
+	if ct.IsComplex {
+		switch ct.Name {
+		case "float":
+			return &Type{Kind: KindComplex, Name: ct.Name, Size: 8, Align: 4}
+		case "double":
+			return &Type{Kind: KindComplex, Name: ct.Name, Size: 16, Align: 8}
+		}
+		r.errorf("%s: %s _Complex has no Go equivalent", where, ct.Name)
+		return &Type{Kind: KindIncomplete, Name: ct.Name + " _Complex"}
+	}
+
+	if p, ok := primitives[ct.Name]; ok {
+		name := ct.Name
+		if name == "" || name == "signed" {
+			name = "int"
+		}
+		align := p.size
+		if align == 0 {
+			align = 1
+		}
+		return &Type{Kind: p.kind, Name: name, Size: p.size, Align: align, Signed: p.signed && !ct.IsUnsigned}
+	}
+
+	if s, ok := r.structDecls[ct.Name]; ok {
+		if s.IsOpaque {
+			return &Type{Kind: KindHandle, Name: ct.Name, Size: 8, Align: 8, Struct: r.resolveStruct(ct.Name)}
+		}
+		if ref {
+			return r.deferLayout(&Type{Kind: KindStruct, Name: ct.Name, Struct: r.structRef(ct.Name)})
+		}
+		rs := r.resolveStruct(ct.Name)
+		return &Type{Kind: KindStruct, Name: ct.Name, Size: rs.Size, Align: rs.Align, Struct: rs}
+	}
+
+	if _, ok := r.enumDecls[ct.Name]; ok {
+		return &Type{Kind: KindEnum, Name: ct.Name, Size: 4, Align: 4, Signed: true, Enum: r.resolveEnum(ct.Name)}
+	}
+
+	if _, ok := r.typedefDecls[ct.Name]; ok {
+		if _, ok := r.typedefs[ct.Name]; !ok && ref {
+			return r.deferLayout(&Type{Kind: KindTypedef, Name: ct.Name, Elem: r.typedefRef(ct.Name)})
+		}
+		td := r.resolveTypedef(ct.Name)
+		return &Type{Kind: KindTypedef, Name: td.Name, Size: td.Size, Align: td.Align, Elem: td.Elem}
+	}
+
+	return &Type{Kind: KindIncomplete, Name: ct.Name}
+}
+
+func (r *resolver) resolveTypedef(name string) *Type {
+	if t, ok := r.typedefs[name]; ok {
+		return t
+	}
+
+	key := "typedef " + name
+	if r.visiting[key] {
+		r.errorf("typedef %s refers to itself", name)
+		return &Type{Kind: KindIncomplete, Name: name}
+	}
+	r.visiting[key] = true
+	defer delete(r.visiting, key)
+
+	elem := r.resolveType(r.typedefDecls[name].SourceType, "typedef "+name)
+	t := &Type{Kind: KindTypedef, Name: name, Size: elem.Size, Align: elem.Align, Elem: elem}
+	r.typedefs[name] = t
+
+	return t
+}
+
+// typedefRef resolves what typedef name stands for as resolveRef does,
+// without caching the result since its layout may not be known yet.
+func (r *resolver) typedefRef(name string) *Type {
+	key := "typedef " + name
+	if r.visiting[key] {
+		r.errorf("typedef %s refers to itself", name)
+		return &Type{Kind: KindIncomplete, Name: name}
+	}
+	r.visiting[key] = true
+	defer delete(r.visiting, key)
+
+	return r.resolveRef(r.typedefDecls[name].SourceType, key, true)
+}
+
+// deferLayout records t to take its size and alignment from the struct it
+// names, or from its element, once every struct is laid out.
+func (r *resolver) deferLayout(t *Type) *Type {
+	r.deferred = append(r.deferred, t)
+	return t
+}
+
+func (r *resolver) resolveEnum(name string) *Enum {
+	if e, ok := r.enums[name]; ok {
+		return e
+	}
+
+	e := &Enum{Name: name, Values: r.enumDecls[name].Values}
+	r.enums[name] = e
+
+	return e
+}
+
+// resolveStruct resolves a struct declaration and computes its layout
+// following the rules GCC and Clang apply for #pragma pack, packed and
+// aligned.
+func (r *resolver) resolveStruct(name string) *Struct {
+	if s, ok := r.structs[name]; ok {
+		return s
+	}
+
+	decl := r.structDecls[name]
+	if decl.IsOpaque {
+		s := &Struct{Name: name, Opaque: true, Natural: true, Size: 8, Align: 8}
+		r.structs[name] = s
+		return s
+	}
+
+	key := "struct " + name
+	if r.visiting[key] {
+		r.errorf("struct %s contains itself by value", name)
+		return &Struct{Name: name, Natural: true, Align: 1}
+	}
+	r.visiting[key] = true
+	defer delete(r.visiting, key)
+
+	// Pointers may already link to the struct; it is laid out in place.
+	s := r.structRef(name)
+	s.Natural = decl.Pack == 0 && decl.Align == 0
+	s.Align = 1
+
+	offset := 0
+	for _, f := range decl.Fields {
+		t := r.resolveValue(f.Type, name+"."+f.Name)
+
+		align := t.Align
+		if decl.Pack > 0 && align > decl.Pack {
+			align = decl.Pack
+		}
+		if f.Align > align {
+			align = f.Align
+		}
+		if f.Align > 0 {
+			s.Natural = false
+		}
+		elem := t.Underlying()
+		if elem.Kind == KindArray {
+			elem = elem.Elem.Underlying()
+		}
+		if elem.Kind == KindStruct && !elem.Struct.Natural {
+			s.Natural = false
+		}
+
+		offset = alignUp(offset, align)
+		s.Fields = append(s.Fields, &Field{Name: f.Name, Type: t, Offset: offset})
+		offset += t.Size
+
+		if align > s.Align {
+			s.Align = align
+		}
+	}
+
+	if decl.Align > s.Align {
+		s.Align = decl.Align
+	}
+	s.Size = alignUp(offset, s.Align)
+
+	if fm := s.FlexibleMember(); fm != nil {
+		r.linkCountField(s, fm, decl.Fields[len(decl.Fields)-1].CountField)
+	}
+
+	r.structs[name] = s
+
+	return s
+}
+
+// structRef returns the struct declared as name, which is not laid out until
+// resolveStruct has finished with it.
+func (r *resolver) structRef(name string) *Struct {
+	if s, ok := r.refs[name]; ok {
+		return s
+	}
+
+	s := &Struct{Name: name}
+	r.refs[name] = s
+
+	return s
+}
+
+func (r *resolver) linkCountField(s *Struct, fm *Field, name string) {
+	if name == "" {
+		return
+	}
+
+	for _, f := range s.Fields {
+		if f.Name != name {
+			continue
+		}
+		if k := f.Type.Underlying().Kind; k != KindInt {
+			r.errorf("%s.%s: count field %s is a %s, not an integer", s.Name, fm.Name, name, k)
+			return
+		}
+		fm.CountField = f
+		return
+	}
+
+	r.errorf("%s.%s: count field %s not found", s.Name, fm.Name, name)
+}
+
+func (r *resolver) resolveFunction(fn parser.Function) *Function {
+	f := Function{
+		Name:     fn.Name,
+		Variadic: fn.IsVariadic,
+	}
+
+	f.Result = r.resolveValue(fn.ReturnType, fn.Name+": return type")
+
+	for i, p := range fn.Params {
+		where := fmt.Sprintf("%s: parameter %d", fn.Name, i+1)
+		if p.Name != "" {
+			where = fmt.Sprintf("%s: parameter %s", fn.Name, p.Name)
+		}
+		f.Params = append(f.Params, &Param{
+			Name:      p.Name,
+			Type:      r.resolveValue(p.Type, where),
+			Direction: p.Direction,
+			Length:    p.Length,
+		})
+	}
+
+	return &f
+}
+
+func alignUp(n, align int) int {
+	if align < 1 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,178 @@
+package sema
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/ffi-converter/parser"
+)
+
+// layout is the resolved layout of a struct, with its field offsets.
+type layout struct {
+	size, align int
+	natural     bool
+	offsets     []int
+}
+
+// resolve parses and resolves header and returns its structs by name.
+func resolve(t *testing.T, header string) map[string]*Struct {
+	t.Helper()
+	h, err := parser.Parse(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := Resolve(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	structs := make(map[string]*Struct)
+	for _, s := range module.Structs {
+		structs[s.Name] = s
+	}
+	return structs
+}
+
+func layoutOf(s *Struct) layout {
+	l := layout{size: s.Size, align: s.Align, natural: s.Natural}
+	for _, f := range s.Fields {
+		l.offsets = append(l.offsets, f.Offset)
+	}
+	return l
+}
+
+// The expected layouts are those gcc gives on x86-64 Linux.
+func TestStructLayout(t *testing.T) {
+	const header = `
+#include <stdint.h>
+typedef struct { uint8_t a; double b; uint16_t c; } Natural;
+#pragma pack(push, 1)
+typedef struct { uint8_t a; double b; uint16_t c; } Pack1;
+#pragma pack(pop)
+#pragma pack(push, 2)
+typedef struct { uint8_t a; double b; uint16_t c; } Pack2;
+#pragma pack(pop)
+typedef struct __attribute__((packed)) { uint8_t a; uint32_t b; } Packed;
+typedef struct __attribute__((aligned(16))) { uint8_t a; uint32_t b; } Aligned;
+typedef struct { uint8_t a; _Alignas(8) uint32_t b; } FieldAligned;
+typedef struct Node { struct Node* next; uint8_t v; } Node;
+typedef struct Outer { struct Inner* in; uint8_t v; } Outer;
+typedef struct Inner { Outer out; uint16_t w; } Inner;
+`
+	tests := []struct {
+		name string
+		want layout
+	}{
+		{"Natural", layout{24, 8, true, []int{0, 8, 16}}},
+		{"Pack1", layout{11, 1, false, []int{0, 1, 9}}},
+		{"Pack2", layout{12, 2, false, []int{0, 2, 10}}},
+		{"Packed", layout{5, 1, false, []int{0, 1}}},
+		{"Aligned", layout{16, 16, false, []int{0, 4}}},
+		{"FieldAligned", layout{16, 8, false, []int{0, 8}}},
+		{"Node", layout{16, 8, true, []int{0, 8}}},
+		{"Inner", layout{24, 8, true, []int{0, 16}}},
+	}
+
+	structs := resolve(t, header)
+	for _, tt := range tests {
+		s, ok := structs[tt.name]
+		if !ok {
+			t.Errorf("%s not resolved", tt.name)
+			continue
+		}
+		if got := layoutOf(s); got.size != tt.want.size || got.align != tt.want.align || got.natural != tt.want.natural || !slices.Equal(got.offsets, tt.want.offsets) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFlexibleArrayLayout(t *testing.T) {
+	const header = `
+#include <stdint.h>
+typedef struct { uint32_t n; uint8_t tag; double values[]; } Flex;
+typedef struct { uint16_t num_data; uint8_t data[]; } FlexBytes;
+`
+	tests := []struct {
+		name  string
+		want  layout
+		count string
+	}{
+		{"Flex", layout{8, 8, true, []int{0, 4, 8}}, "n"},
+		{"FlexBytes", layout{2, 2, true, []int{0, 2}}, "num_data"},
+	}
+
+	structs := resolve(t, header)
+	for _, tt := range tests {
+		s, ok := structs[tt.name]
+		if !ok {
+			t.Errorf("%s not resolved", tt.name)
+			continue
+		}
+		if got := layoutOf(s); got.size != tt.want.size || got.align != tt.want.align || got.natural != tt.want.natural || !slices.Equal(got.offsets, tt.want.offsets) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if fm := s.FlexibleMember(); fm == nil || fm.CountField == nil || fm.CountField.Name != tt.count {
+			t.Errorf("%s: flexible member %+v, want one counted by %s", tt.name, fm, tt.count)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string // empty when header resolves
+	}{
+		{"void f(Missing m);", "f: parameter m: undefined type Missing"},
+		{"typedef struct { int a; } T; typedef enum { X } T;", "ambiguous type T: declared as both struct and enum"},
+		{"typedef int T; typedef long T;", "ambiguous type T: declared by conflicting typedefs"},
+		{"typedef struct Node { struct Node next; } Node;", "struct Node contains itself by value"},
+		{"typedef struct Node { struct Node* next; int v; } Node;", ""},
+		{"typedef struct Item Item_t;\ntypedef struct Item { Item_t* next; int v; } Item;", ""},
+		{"typedef struct A { struct B* b; } A;\ntypedef struct B { A a; } B;", ""},
+		{"typedef struct B { struct A a; } B;\ntypedef struct A { struct B* b; } A;", ""},
+	}
+
+	for _, tt := range tests {
+		h, err := parser.Parse(tt.header)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.header, err)
+		}
+		_, err = Resolve(h)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.header, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.header, err, tt.want)
+		}
+	}
+}
+
+func TestTypedefChain(t *testing.T) {
+	h, err := parser.Parse(`
+#include <stdint.h>
+typedef uint16_t port_t;
+typedef port_t listen_port_t;
+void f(const listen_port_t* p);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := Resolve(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(module.Functions) != 1 {
+		t.Fatalf("resolved %+v", module.Functions)
+	}
+	p := module.Functions[0].Params[0].Type
+	if p.Kind != KindPointer || !p.Elem.Const {
+		t.Fatalf("got %+v, want a pointer to const", p)
+	}
+	u := p.Elem.Underlying()
+	if u.Kind != KindInt || u.Name != "uint16_t" || u.Size != 2 || u.Signed {
+		t.Errorf("underlying type %+v, want uint16_t", u)
+	}
+}
@@ -0,0 +1,142 @@
+package sema
+
+import "github.com/ardanlabs/ffi-converter/parser"
+
+type Kind int
+
+const (
+	KindVoid Kind = iota
+	KindBool
+	KindInt
+	KindFloat
+	KindComplex
+	KindPointer
+	KindArray
+	KindStruct
+	KindHandle
+	KindEnum
+	KindTypedef
+	KindIncomplete
+)
+
+var kindNames = [...]string{
+	KindVoid:       "void",
+	KindBool:       "bool",
+	KindInt:        "int",
+	KindFloat:      "float",
+	KindComplex:    "complex",
+	KindPointer:    "pointer",
+	KindArray:      "array",
+	KindStruct:     "struct",
+	KindHandle:     "handle",
+	KindEnum:       "enum",
+	KindTypedef:    "typedef",
+	KindIncomplete: "incomplete",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return "unknown"
+}
+
+// Type is a resolved C type. Named types (structs, handles, enums and
+// typedefs) link to their declaration; pointers, arrays and typedefs link to
+// their element type through Elem.
+type Type struct {
+	Kind   Kind
+	Name   string
+	Size   int
+	Align  int
+	Signed bool
+	Const  bool
+
+	Elem     *Type
+	Len      int
+	Flexible bool
+
+	Struct *Struct
+	Enum   *Enum
+}
+
+// Underlying returns t with all typedefs stripped.
+func (t *Type) Underlying() *Type {
+	for t.Kind == KindTypedef {
+		t = t.Elem
+	}
+	return t
+}
+
+// IsString reports whether t is a pointer to char.
+func (t *Type) IsString() bool {
+	u := t.Underlying()
+	if u.Kind != KindPointer {
+		return false
+	}
+	e := u.Elem.Underlying()
+	return e.Kind == KindInt && e.Name == "char"
+}
+
+// IsStructValue reports whether t is a struct passed by value.
+func (t *Type) IsStructValue() bool {
+	return t.Underlying().Kind == KindStruct
+}
+
+// IsPacked reports whether t is a struct value whose layout cannot be
+// described to libffi.
+func (t *Type) IsPacked() bool {
+	u := t.Underlying()
+	return u.Kind == KindStruct && !u.Struct.Natural
+}
+
+type Field struct {
+	Name       string
+	Type       *Type
+	Offset     int
+	CountField *Field
+}
+
+type Struct struct {
+	Name    string
+	Fields  []*Field
+	Opaque  bool
+	Natural bool
+	Size    int
+	Align   int
+}
+
+// FlexibleMember returns the trailing flexible array member, if any.
+func (s *Struct) FlexibleMember() *Field {
+	if n := len(s.Fields); n > 0 && s.Fields[n-1].Type.Flexible {
+		return s.Fields[n-1]
+	}
+	return nil
+}
+
+type Enum struct {
+	Name   string
+	Values []parser.EnumValue
+}
+
+type Param struct {
+	Name      string
+	Type      *Type
+	Direction string // annotated direction: "in", "out", "inout" or empty
+	Length    string // annotated parameter holding the element count, if any
+}
+
+type Function struct {
+	Name     string
+	Result   *Type
+	Params   []*Param
+	Variadic bool
+}
+
+// Module is a header resolved into a graph of linked declarations.
+type Module struct {
+	Structs   []*Struct
+	Enums     []*Enum
+	Typedefs  []*Type
+	Functions []*Function
+}
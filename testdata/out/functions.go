@@ -1,3 +1,5 @@
+// Code generated by ffi-converter. DO NOT EDIT.
+
 package calculator
 
 import (
@@ -5,28 +7,25 @@ import (
 	"unsafe"
 
 	"github.com/jupiterrider/ffi"
-	"golang.org/x/sys/unix"
 )
 
-var _ = unix.BytePtrFromString
-
 var (
 	calcDefaultConfigFunc ffi.Fun
-	calcCreateFunc ffi.Fun
-	calcFreeFunc ffi.Fun
-	calcAddFunc ffi.Fun
-	calcGetVersionFunc ffi.Fun
-	calcFormatFunc ffi.Fun
+	calcCreateFunc        ffi.Fun
+	calcFreeFunc          ffi.Fun
+	calcAddFunc           ffi.Fun
+	calcGetVersionFunc    ffi.Fun
+	calcFormatFunc        ffi.Fun
 )
 
 func loadFuncs() error {
 	var err error
 
-	if calcDefaultConfigFunc, err = lib.Prep("calc_default_config", &FFITypeCalcconfig); err != nil {
+	if calcDefaultConfigFunc, err = lib.Prep("calc_default_config", &FFITypeCalcConfig); err != nil {
 		return fmt.Errorf("calc_default_config: %w", err)
 	}
 
-	if calcCreateFunc, err = lib.Prep("calc_create", &ffi.TypePointer, &FFITypeCalcconfig); err != nil {
+	if calcCreateFunc, err = lib.Prep("calc_create", &ffi.TypePointer, &FFITypeCalcConfig); err != nil {
 		return fmt.Errorf("calc_create: %w", err)
 	}
 
@@ -49,13 +48,13 @@ func loadFuncs() error {
 	return nil
 }
 
-func CalcDefaultConfig() Calcconfig {
-	var result Calcconfig
+func CalcDefaultConfig() CalcConfig {
+	var result CalcConfig
 	calcDefaultConfigFunc.Call(unsafe.Pointer(&result))
 	return result
 }
 
-func CalcCreate(config Calcconfig) Calc {
+func CalcCreate(config CalcConfig) Calc {
 	var result Calc
 	calcCreateFunc.Call(unsafe.Pointer(&result), &config)
 	return result
@@ -74,16 +73,16 @@ func CalcAdd(calc Calc, a float64, b float64) float64 {
 func CalcGetVersion() string {
 	var resultPtr *byte
 	calcGetVersionFunc.Call(unsafe.Pointer(&resultPtr))
-	if resultPtr == nil {
-		return ""
-	}
-	return unix.BytePtrToString(resultPtr)
+	return bytePtrToString(resultPtr)
 }
 
-func CalcFormat(calc Calc, buf string, bufSize uint64) int32 {
-	bufPtr, _ := unix.BytePtrFromString(buf)
+func CalcFormat(calc Calc, buf []byte) int32 {
+	var bufPtr unsafe.Pointer
+	if len(buf) > 0 {
+		bufPtr = unsafe.Pointer(&buf[0])
+	}
+	bufSizeC := uint64(len(buf))
 	var result ffi.Arg
-	calcFormatFunc.Call(unsafe.Pointer(&result), unsafe.Pointer(&calc), unsafe.Pointer(&bufPtr), unsafe.Pointer(&bufSize))
+	calcFormatFunc.Call(unsafe.Pointer(&result), unsafe.Pointer(&calc), unsafe.Pointer(&bufPtr), unsafe.Pointer(&bufSizeC))
 	return int32(result)
 }
-
@@ -1,9 +1,13 @@
+// Code generated by ffi-converter. DO NOT EDIT.
+
 package calculator
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"unsafe"
 
 	"github.com/jupiterrider/ffi"
 )
@@ -21,6 +25,10 @@ func Load(path string) error {
 		return err
 	}
 
+	if err := verifyLayouts(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -38,3 +46,32 @@ func getLibraryPath(basePath string) string {
 	}
 	return filepath.Join(basePath, filename)
 }
+
+// verifyLayouts checks the Go structs against the layouts libffi computes for
+// their descriptors, which are the layouts of the C compiler.
+func verifyLayouts() error {
+	var errs []error
+	check := func(what string, goValue uintptr, cValue uint64) {
+		if uint64(goValue) != cValue {
+			errs = append(errs, fmt.Errorf("%s: Go %d, C %d", what, goValue, cValue))
+		}
+	}
+
+	{
+		var s CalcConfig
+		var offsets [3]uint64
+		if status := ffi.GetStructOffsets(ffi.DefaultAbi, &FFITypeCalcConfig, &offsets[0]); status != ffi.OK {
+			return fmt.Errorf("CalcConfig: computing layout: %v", status)
+		}
+		check("CalcConfig size", unsafe.Sizeof(s), FFITypeCalcConfig.Size)
+		check("CalcConfig alignment", unsafe.Alignof(s), uint64(FFITypeCalcConfig.Alignment))
+		check("CalcConfig.value offset", unsafe.Offsetof(s.Value), offsets[0])
+		check("CalcConfig.precision offset", unsafe.Offsetof(s.Precision), offsets[1])
+		check("CalcConfig.use_cache offset", unsafe.Offsetof(s.UseCache), offsets[2])
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("struct layouts differ from C:\n%w", errors.Join(errs...))
+	}
+	return nil
+}